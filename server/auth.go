@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Largest request body which will be buffered while looking for a LoginToken in it.
+const maxAuthBodyBytes = 1 << 20
+
+// Generates the random secret part of a token.
+func generateSecret() (string, error) {
+	secret := [32]byte{}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret[:]), nil
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// Session tokens are "<session uuid>.<secret>", so that sessions can be looked up without
+// storing the secret.
+func splitSessionToken(token string) (Uuid, string, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return InvalidUuid, "", fmt.Errorf("Malformed session token")
+	}
+	uuid, err := UuidFromString(token[:i])
+	if err != nil {
+		return InvalidUuid, "", fmt.Errorf("Malformed session token")
+	}
+	return uuid, token[i+1:], nil
+}
+
+// How long login tokens issued before sessions existed were valid for.
+const legacyLoginTokenDuration = 365 * 24 * time.Hour
+
+// How long a session lasts without being refreshed.
+const sessionDuration = 90 * 24 * time.Hour
+
+// How long an access token lasts before it must be refreshed.
+const accessTokenDuration = 15 * time.Minute
+
+// How many rotated refresh tokens are remembered for detecting reuse.
+const maxUsedRefreshTokens = 100
+
+// How stale Session.LastSeen may get before it is updated, so that not every request writes to
+// the session.
+const lastSeenGranularity = time.Minute
+
+// Creates a new session for user on device, returning it along with a LoginResponse holding the
+// tokens which authenticate it.
+func (s *Server) newSession(ctx context.Context, user *User, device string) (*Session, *LoginResponse, error) {
+	// TODO check collisions of the uuid and retry or crash
+	uuid, err := generateUuid()
+	if err != nil {
+		return nil, nil, err
+	}
+	loginSecret, err := generateSecret()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	validUntil := now.Add(sessionDuration).Unix()
+	session := &Session{
+		Uuid:   uuid,
+		User:   user.Uuid,
+		Device: device,
+		LoginToken: LoginToken{
+			ValidUntil: validUntil,
+			Uuid:       uuid,
+			UserEmail:  user.Email,
+		},
+		LoginTokenHash: hashSecret(loginSecret),
+		CreatedAt:      now.Unix(),
+		LastSeen:       now.Unix(),
+		ValidUntil:     validUntil,
+	}
+	tokens, err := rotateSessionTokens(session)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = s.AddSession(ctx, session); err != nil {
+		return nil, nil, err
+	}
+	loginToken := session.LoginToken
+	loginToken.Secret = loginSecret
+	return session, &LoginResponse{
+		User:                   *user,
+		LoginToken:             loginToken,
+		SessionToken:           tokens.SessionToken,
+		SessionTokenValidUntil: tokens.SessionTokenValidUntil,
+		RefreshToken:           tokens.RefreshToken,
+	}, nil
+}
+
+// Issues a new access and refresh token for a session, replacing the previous ones. The
+// session must be saved afterwards.
+func rotateSessionTokens(session *Session) (*RefreshResponse, error) {
+	accessSecret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+	refreshSecret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+	if session.RefreshTokenHash != "" {
+		session.UsedRefreshTokenHashes = append(
+			session.UsedRefreshTokenHashes, session.RefreshTokenHash,
+		)
+		if extra := len(session.UsedRefreshTokenHashes) - maxUsedRefreshTokens; extra > 0 {
+			session.UsedRefreshTokenHashes = session.UsedRefreshTokenHashes[extra:]
+		}
+	}
+	now := time.Now()
+	session.AccessTokenHash = hashSecret(accessSecret)
+	session.AccessValidUntil = now.Add(accessTokenDuration).Unix()
+	session.RefreshTokenHash = hashSecret(refreshSecret)
+	return &RefreshResponse{
+		SessionToken:           fmt.Sprintf("%s.%s", session.Uuid, accessSecret),
+		SessionTokenValidUntil: session.AccessValidUntil,
+		RefreshToken:           fmt.Sprintf("%s.%s", session.Uuid, refreshSecret),
+	}, nil
+}
+
+// Exchanges a refresh token for new tokens. If a refresh token which was already exchanged is
+// used again, the whole session is revoked since one of its tokens must have been stolen.
+func (s *Server) Refresh(ctx context.Context, refreshToken string) (*RefreshResponse, error) {
+	uuid, secret, err := splitSessionToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	defer s.sessionLocks.Lock(uuid)()
+	session, err := s.GetSession(ctx, uuid)
+	if err != nil {
+		return nil, err
+	} else if session == nil || session.Expired() {
+		return nil, fmt.Errorf("Session does not exist")
+	}
+	if err = s.checkTokensValidAfter(ctx, session.User, session.CreatedAt); err != nil {
+		return nil, err
+	}
+	hash := []byte(hashSecret(secret))
+	if subtle.ConstantTimeCompare(hash, []byte(session.RefreshTokenHash)) != 1 {
+		for _, used := range session.UsedRefreshTokenHashes {
+			if subtle.ConstantTimeCompare(hash, []byte(used)) == 1 {
+				if err = s.DeleteSession(ctx, session.User, session.Uuid); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("Refresh token was reused, session has been revoked")
+			}
+		}
+		return nil, fmt.Errorf("Session does not exist")
+	}
+	tokens, err := rotateSessionTokens(session)
+	if err != nil {
+		return nil, err
+	}
+	session.LastSeen = time.Now().Unix()
+	session.ValidUntil = time.Now().Add(sessionDuration).Unix()
+	if err = s.AddSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Applies update to the latest version of a session and saves it. Nothing is saved if the
+// session no longer exists, so that a revocation since it was read is not undone.
+func (s *Server) updateSession(ctx context.Context, uuid Uuid, update func(*Session)) error {
+	defer s.sessionLocks.Lock(uuid)()
+	session, err := s.GetSession(ctx, uuid)
+	if err != nil || session == nil {
+		return err
+	}
+	update(session)
+	return s.AddSession(ctx, session)
+}
+
+// Records that a session was just used.
+func (s *Server) touchSession(ctx context.Context, session *Session) {
+	now := time.Now()
+	if now.Sub(time.Unix(session.LastSeen, 0)) < lastSeenGranularity {
+		return
+	}
+	err := s.updateSession(ctx, session.Uuid, func(session *Session) {
+		session.LastSeen = now.Unix()
+	})
+	if err != nil {
+		fmt.Printf("Failed to update session: %v\n", err)
+	}
+}
+
+// Rejects tokens of user which were issued before they last logged out everywhere.
+func (s *Server) checkTokensValidAfter(ctx context.Context, user Uuid, issuedAt int64) error {
+	validAfter, err := s.TokensValidAfter(ctx, user)
+	if err != nil {
+		return err
+	}
+	if issuedAt < validAfter {
+		return fmt.Errorf(
+			"Token was issued at %v before logging out at %v",
+			time.Unix(issuedAt, 0), time.Unix(validAfter, 0),
+		)
+	}
+	return nil
+}
+
+// Revokes a single session of user.
+func (s *Server) revokeSession(ctx context.Context, user, uuid Uuid) error {
+	defer s.sessionLocks.Lock(uuid)()
+	return s.DeleteSession(ctx, user, uuid)
+}
+
+// Revokes every session of user, along with any tokens issued before now.
+func (s *Server) revokeAllSessions(ctx context.Context, user Uuid) error {
+	if err := s.SetTokensValidAfter(ctx, user, time.Now().Unix()); err != nil {
+		return err
+	}
+	sessions, err := s.SessionsForUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err = s.revokeSession(ctx, user, session.Uuid); err != nil {
+			return err
+		}
+	}
+	return s.DeleteSessionsForUser(ctx, user)
+}
+
+// Ends the session a user made a request with, or all of their sessions if everywhere is set.
+// The push token of the device is removed too, so that it stops receiving notifications.
+func (s *Server) Logout(ctx context.Context, user *User, session *Session, everywhere bool) error {
+	if everywhere {
+		if err := s.revokeAllSessions(ctx, user.Uuid); err != nil {
+			return err
+		}
+		if err := s.DeleteLegacyLoginToken(ctx, user.Email); err != nil {
+			return err
+		}
+		return s.DeleteNotifToken(ctx, user.Uuid)
+	}
+	if session == nil {
+		// Login tokens from before sessions existed were the only login of the user.
+		if err := s.DeleteLegacyLoginToken(ctx, user.Email); err != nil {
+			return err
+		}
+		return s.DeleteNotifToken(ctx, user.Uuid)
+	}
+	if err := s.revokeSession(ctx, user.Uuid, session.Uuid); err != nil {
+		return err
+	}
+	if session.NotifToken == "" {
+		return nil
+	}
+	// Another device may have registered its own push token since.
+	notifToken, err := s.NotifToken(ctx, user.Uuid)
+	if err != nil || notifToken != session.NotifToken {
+		return err
+	}
+	return s.DeleteNotifToken(ctx, user.Uuid)
+}
+
+// Checks that a session token is a valid access token, and returns the session it is for.
+func (s *Server) ValidateSessionToken(ctx context.Context, token string) (*Session, error) {
+	uuid, secret, err := splitSessionToken(token)
+	if err != nil {
+		return nil, err
+	}
+	session, err := s.GetSession(ctx, uuid)
+	if err != nil {
+		return nil, err
+	} else if session == nil {
+		return nil, fmt.Errorf("Session does not exist")
+	}
+	hash := []byte(hashSecret(secret))
+	if subtle.ConstantTimeCompare(hash, []byte(session.AccessTokenHash)) != 1 {
+		return nil, fmt.Errorf("Session does not exist")
+	}
+	if session.Expired() {
+		return nil, fmt.Errorf(
+			"Session has expired, was valid until %v & is now %v",
+			time.Unix(session.ValidUntil, 0), time.Now(),
+		)
+	}
+	if time.Unix(session.AccessValidUntil, 0).Before(time.Now()) {
+		return nil, fmt.Errorf("Session token has expired, it must be refreshed")
+	}
+	if err = s.checkTokensValidAfter(ctx, session.User, session.CreatedAt); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+type userContextKey struct{}
+
+type sessionContextKey struct{}
+
+// Returns the user who made a request, which is only set in handlers wrapped by authenticated.
+func UserFromContext(ctx context.Context) *User {
+	user, _ := ctx.Value(userContextKey{}).(*User)
+	return user
+}
+
+// Returns the session a request was made with, which is only set in handlers wrapped by
+// authenticated. It is nil for login tokens issued before sessions existed.
+func SessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionContextKey{}).(*Session)
+	return session
+}
+
+// authenticated wraps a handler so that it is only called for requests from a logged in user,
+// who can be found with UserFromContext.
+func (s *Server) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, session, err := s.authenticate(r)
+		if err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Error validating login token: %v", err)
+			return
+		}
+		if session != nil {
+			s.touchSession(r.Context(), session)
+		}
+		ctx := context.WithValue(r.Context(), userContextKey{}, user)
+		ctx = context.WithValue(ctx, sessionContextKey{}, session)
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// Finds the user and session which made a request, from the session token in the Authorization
+// header or otherwise the LoginToken in the body.
+func (s *Server) authenticate(r *http.Request) (*User, *Session, error) {
+	ctx := r.Context()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth {
+			return nil, nil, fmt.Errorf("Authorization must be a Bearer token")
+		}
+		session, err := s.ValidateSessionToken(ctx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+		user, err := s.activeUser(ctx, session, "")
+		return user, session, err
+	}
+
+	// Read the body so that the handler can still decode it afterwards.
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxAuthBodyBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var req struct {
+		LoginToken *LoginToken `json:"loginToken"`
+	}
+	if err = json.Unmarshal(body, &req); err != nil {
+		return nil, nil, err
+	} else if req.LoginToken == nil {
+		return nil, nil, fmt.Errorf("Missing login token")
+	}
+	session, err := s.sessionForLoginToken(ctx, *req.LoginToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := s.activeUser(ctx, session, req.LoginToken.UserEmail)
+	return user, session, err
+}
+
+// Loads the user who a validated token belongs to, who must still exist and not be suspended.
+// session is nil for legacy login tokens, whose user is found by email instead.
+func (s *Server) activeUser(ctx context.Context, session *Session, email Email) (*User, error) {
+	var user *User
+	var err error
+	if session != nil {
+		user, err = s.GetUser(ctx, session.User)
+	} else {
+		user, err = s.UserByEmail(ctx, email)
+	}
+	if err != nil {
+		return nil, err
+	} else if user == nil {
+		return nil, fmt.Errorf("User does not exist")
+	} else if user.Suspended {
+		return nil, errSuspended
+	}
+	return user, nil
+}
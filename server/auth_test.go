@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		_, ts := newTestServer(t, store)
+		c := newTestClients(t, ts, 1)[0]
+
+		// Requests made through post send the session token as a bearer token.
+		if _, err := c.RecvMsg(false); err != nil {
+			t.Errorf("Failed with session token: %v", err)
+		}
+
+		sessionToken := c.sessionToken
+		c.sessionToken = ""
+		if _, err := c.RecvMsg(false); err != nil {
+			t.Errorf("Failed with login token in body: %v", err)
+		}
+
+		// The uuid of a login token is the prefix of the session token, so it must not be enough.
+		loginToken := c.loginToken
+		c.loginToken.Secret = ""
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Succeeded with login token missing its secret")
+		}
+		c.loginToken.Secret = loginToken.Secret + "x"
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Succeeded with login token with wrong secret")
+		}
+
+		c.loginToken = LoginToken{}
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Succeeded without any token")
+		}
+
+		c.sessionToken = sessionToken + "x"
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Succeeded with wrong session token")
+		}
+		c.sessionToken = "garbage"
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Succeeded with malformed session token")
+		}
+	})
+}
+
+func TestMultipleSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		_, ts := newTestServer(t, store)
+		phone := newTestClients(t, ts, 1)[0]
+		tablet := NewMojiClient(ts.URL)
+		if err := tablet.Login(string(phone.user.Email)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Logging in on the tablet must not log out the phone.
+		for _, c := range []*mojiClient{phone, tablet} {
+			if _, err := c.RecvMsg(false); err != nil {
+				t.Fatalf("Session was not valid after second login: %v", err)
+			}
+		}
+		list, err := phone.SessionOp(ListSessions, InvalidUuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Sessions) != 2 {
+			t.Fatalf("Got %d sessions, want 2", len(list.Sessions))
+		}
+		var tabletSession Uuid
+		for _, session := range list.Sessions {
+			if !session.Current {
+				tabletSession = session.Uuid
+			}
+		}
+
+		if _, err = phone.SessionOp(RevokeSession, tabletSession); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tablet.RecvMsg(false); err == nil {
+			t.Error("Revoked session is still valid")
+		}
+		if _, err := phone.RecvMsg(false); err != nil {
+			t.Errorf("Revoking another session logged out this one: %v", err)
+		}
+
+		if _, err = phone.SessionOp(RevokeAllSessions, InvalidUuid); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := phone.RecvMsg(false); err == nil {
+			t.Error("Session is still valid after revoking all sessions")
+		}
+	})
+}
+
+func TestRefreshSession(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		_, ts := newTestServer(t, store)
+		c := newTestClients(t, ts, 1)[0]
+
+		oldSessionToken, oldRefreshToken := c.sessionToken, c.refreshToken
+		if err := c.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if c.sessionToken == oldSessionToken || c.refreshToken == oldRefreshToken {
+			t.Error("Refreshing did not rotate tokens")
+		}
+		if _, err := c.RecvMsg(false); err != nil {
+			t.Errorf("Refreshed session token is not valid: %v", err)
+		}
+		newSessionToken := c.sessionToken
+		c.sessionToken = oldSessionToken
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Session token is still valid after refreshing")
+		}
+		c.sessionToken = newSessionToken
+
+		// Someone replaying the old refresh token must revoke the whole session.
+		stolen := NewMojiClient(ts.URL)
+		stolen.refreshToken = oldRefreshToken
+		if err := stolen.Refresh(); err == nil {
+			t.Fatal("Refreshed with a refresh token which was already used")
+		}
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Session is still valid after its refresh token was reused")
+		}
+		if err := c.Refresh(); err == nil {
+			t.Error("Refreshed a revoked session")
+		}
+	})
+}
+
+func TestSessionTokenExpires(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		_, ts := newTestServer(t, store)
+		c := newTestClients(t, ts, 1)[0]
+
+		uuid, _, err := splitSessionToken(c.sessionToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		session, err := store.GetSession(ctx, uuid)
+		if err != nil || session == nil {
+			t.Fatalf("Failed to get session: %v", err)
+		}
+		session.AccessValidUntil = time.Now().Add(-time.Minute).Unix()
+		if err = store.AddSession(ctx, session); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Expired session token is still valid")
+		}
+		sessionToken := c.sessionToken
+		c.sessionToken = ""
+		if _, err := c.RecvMsg(false); err != nil {
+			t.Errorf("Login token stopped working along with the session token: %v", err)
+		}
+		c.sessionToken = sessionToken
+		if err := c.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.RecvMsg(false); err != nil {
+			t.Errorf("Refreshed session token is not valid: %v", err)
+		}
+	})
+}
+
+func TestLogout(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		_, ts := newTestServer(t, store)
+		phone := newTestClients(t, ts, 1)[0]
+		tablet := NewMojiClient(ts.URL)
+		if err := tablet.Login(string(phone.user.Email)); err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+
+		if err := phone.SetPushToken("ExponentPushToken[phone]"); err != nil {
+			t.Fatal(err)
+		}
+		if err := phone.Logout(false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := phone.RecvMsg(false); err == nil {
+			t.Error("Session is still valid after logging out")
+		}
+		if _, err := tablet.RecvMsg(false); err != nil {
+			t.Errorf("Logging out of one session logged out another: %v", err)
+		}
+		if token, err := store.NotifToken(ctx, phone.user.Uuid); err != nil || token != "" {
+			t.Errorf("Push token %q was not removed on logout: %v", token, err)
+		}
+
+		// The tablet's push token is kept if a different device logs out.
+		if err := tablet.SetPushToken("ExponentPushToken[tablet]"); err != nil {
+			t.Fatal(err)
+		}
+		if err := phone.Login(string(phone.user.Email)); err != nil {
+			t.Fatal(err)
+		}
+		if err := phone.Logout(false); err != nil {
+			t.Fatal(err)
+		}
+		if token, _ := store.NotifToken(ctx, phone.user.Uuid); token != "ExponentPushToken[tablet]" {
+			t.Errorf("Push token of another device was removed, got %q", token)
+		}
+
+		if err := phone.Login(string(phone.user.Email)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tablet.Logout(true); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []*mojiClient{phone, tablet} {
+			if _, err := c.RecvMsg(false); err == nil {
+				t.Error("Session is still valid after logging out everywhere")
+			}
+		}
+		if token, _ := store.NotifToken(ctx, phone.user.Uuid); token != "" {
+			t.Errorf("Push token %q was not removed on logging out everywhere", token)
+		}
+		if err := phone.Login(string(phone.user.Email)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := phone.RecvMsg(false); err != nil {
+			t.Errorf("Logging in again after logging out everywhere failed: %v", err)
+		}
+	})
+}
+
+func TestTokensValidAfter(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		_, ts := newTestServer(t, store)
+		c := newTestClients(t, ts, 1)[0]
+		ctx := context.Background()
+
+		// Sessions issued before the cutoff are rejected even if they were not deleted.
+		later := time.Now().Add(time.Minute).Unix()
+		if err := store.SetTokensValidAfter(ctx, c.user.Uuid, later); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Session token issued before cutoff is still valid")
+		}
+		sessionToken := c.sessionToken
+		c.sessionToken = ""
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Login token issued before cutoff is still valid")
+		}
+		c.sessionToken = sessionToken
+		if err := c.Refresh(); err == nil {
+			t.Error("Refreshed session issued before cutoff")
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errBlocked = errors.New("One of you has blocked the other")
+
+// Blocks other for user. They stop being friends, and neither can message or see the other.
+func (s *Server) block(ctx context.Context, user, other Uuid) error {
+	defer s.friendLocks.LockPair(user, other)()
+	if err := s.Block(ctx, user, other); err != nil {
+		return err
+	}
+	return s.unfriend(ctx, user, other)
+}
+
+func (s *Server) unblock(ctx context.Context, user, other Uuid) error {
+	defer s.friendLocks.LockPair(user, other)()
+	return s.Unblock(ctx, user, other)
+}
+
+// Returns whether either of a or b has blocked the other.
+func (s *Server) blockedBetween(ctx context.Context, a, b Uuid) (bool, error) {
+	if blocked, err := s.HasBlocked(ctx, a, b); err != nil || blocked {
+		return blocked, err
+	}
+	return s.HasBlocked(ctx, b, a)
+}
+
+// Returns everyone user has blocked or was blocked by, who should not see anything of user.
+func (s *Server) blockSet(ctx context.Context, user Uuid) (map[Uuid]struct{}, error) {
+	blocked, err := s.ListBlocked(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	blockedBy, err := s.ListBlockedBy(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[Uuid]struct{}, len(blocked)+len(blockedBy))
+	for _, uuids := range [][]Uuid{blocked, blockedBy} {
+		for _, uuid := range uuids {
+			out[uuid] = struct{}{}
+		}
+	}
+	return out, nil
+}
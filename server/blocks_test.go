@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBlock(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 3)
+		alice, bob, carol := clients[0], clients[1], clients[2]
+		ctx := context.Background()
+		group := Group{Uuid: Uuid(1), Name: "blockers", Users: map[Uuid]string{}}
+		for _, c := range clients {
+			group.Users[c.UserID()] = c.user.Name
+			if err := s.AddUserToGroup(ctx, c.UserID(), group.Uuid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.AddGroup(ctx, &group); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.FriendOp(alice.UserID(), AddFriend); err != nil {
+			t.Fatal(err)
+		}
+		msg := Message{Emojis: "🍕🍔🌯", SentAt: time.Now().Unix(), TTL: 60, LocalTime: 12}
+		// Sent before blocking, so it should be hidden from alice afterwards.
+		if err := bob.SendMsg(alice.UserID(), MsgFriend, msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := alice.BlockOp(bob.UserID(), BlockUser); err != nil {
+			t.Fatal(err)
+		}
+		list, err := alice.BlockOp(InvalidUuid, ListBlockedOp)
+		if err != nil || len(list.Blocked) != 1 || list.Blocked[0].Uuid != bob.UserID() {
+			t.Fatalf("Got blocked %v, want bob: %v", list, err)
+		}
+		if reqs, _ := alice.FriendRequests(); len(reqs.Incoming) != 0 {
+			t.Errorf("Friend request %v was kept after blocking", reqs)
+		}
+		if recv, err := alice.RecvMsg(false); err != nil || len(recv.NewMessages) != 0 {
+			t.Errorf("Got %v, want messages from blocked users hidden: %v", recv, err)
+		}
+
+		if err = bob.SendMsg(alice.UserID(), MsgFriend, msg); err == nil {
+			t.Error("Sent a message to someone who blocked you")
+		}
+		if err = alice.SendMsg(bob.UserID(), MsgFriend, msg); err == nil {
+			t.Error("Sent a message to someone you blocked")
+		}
+		if err = bob.FriendOp(alice.UserID(), AddFriend); err == nil {
+			t.Error("Asked someone who blocked you to be friends")
+		}
+		if err = bob.SendMsg(group.Uuid, MsgGroup, msg); err != nil {
+			t.Fatal(err)
+		}
+		if recv, _ := alice.RecvMsg(false); len(recv.NewMessages) != 0 {
+			t.Errorf("Got group message %v from blocked user", recv.NewMessages)
+		}
+		if recv, _ := carol.RecvMsg(false); len(recv.NewMessages) != 1 {
+			t.Errorf("Got %v, want the group message", recv.NewMessages)
+		}
+		for _, c := range []*mojiClient{alice, bob} {
+			people, err := c.ListPeople(All)
+			if err != nil || len(people) != 1 || people[0].Uuid != carol.UserID() {
+				t.Errorf("Got %v listing people, want only carol: %v", people, err)
+			}
+		}
+
+		if _, err = alice.BlockOp(bob.UserID(), UnblockUser); err != nil {
+			t.Fatal(err)
+		}
+		if err = bob.SendMsg(alice.UserID(), MsgFriend, msg); err != nil {
+			t.Errorf("Failed to send message after unblocking: %v", err)
+		}
+	})
+}
@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	//"io/ioutil"
+	"io/ioutil"
 	"net/http"
 )
 
@@ -13,8 +13,12 @@ type mojiClient struct {
 	httpc *http.Client
 	// loginToken will not be zero when the client has logged in
 	loginToken LoginToken
-	user       User
-	dst        string
+	// sessionToken is sent as a bearer token by requests made through post
+	sessionToken string
+	// refreshToken is exchanged for a new sessionToken by Refresh
+	refreshToken string
+	user         User
+	dst          string
 }
 
 func NewMojiClient(addr string) *mojiClient {
@@ -42,6 +46,8 @@ func (mc *mojiClient) SignUp(name, email string) error {
 		return err
 	}
 	mc.loginToken = login.LoginToken
+	mc.sessionToken = login.SessionToken
+	mc.refreshToken = login.RefreshToken
 	mc.user = login.User
 	return nil
 }
@@ -50,26 +56,13 @@ func (mc *mojiClient) UserID() Uuid {
 	return mc.user.Uuid
 }
 
-func (mc *mojiClient) ListPeople() error {
-	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
-	req := ListPeopleRequest{LoginToken: mc.loginToken, Amount: 50, Kind: 0}
-	if err := enc.Encode(req); err != nil {
-		return err
+func (mc *mojiClient) ListPeople(kind ListPeopleKind) ([]PublicUser, error) {
+	req := ListPeopleRequest{LoginToken: mc.loginToken, Amount: 50, Kind: kind}
+	var resp ListPeopleResponse
+	if err := mc.post("/api/v1/list_friends/", req, &resp); err != nil {
+		return nil, err
 	}
-	resp, err := mc.httpc.Post(mc.dst+"/api/v1/list_friends/", "application/json", &buf)
-	if err != nil {
-		return err
-	}
-	// TODO check response
-	dec := json.NewDecoder(resp.Body)
-	var listResp ListPeopleResponse
-	if err := dec.Decode(&listResp); err != nil {
-		return err
-	}
-	fmt.Println(resp.Status)
-	fmt.Println(listResp)
-	return nil
+	return resp.People, nil
 }
 
 func (mc *mojiClient) ListGroups(op ListGroupKind) error {
@@ -94,56 +87,251 @@ func (mc *mojiClient) ListGroups(op ListGroupKind) error {
 	return nil
 }
 
+// ListGroupsNear lists groups within withinKm of near, nearest first.
+func (mc *mojiClient) ListGroupsNear(near GeoLocation, withinKm float64) ([]Group, error) {
+	req := ListGroupRequest{
+		LoginToken: mc.loginToken, Amount: 50, Kind: AllGroups, Near: &near, WithinKm: withinKm,
+	}
+	var resp ListGroupResponse
+	if err := mc.post("/api/v1/list_groups/", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Groups, nil
+}
+
 func (mc *mojiClient) Login(email string) error {
-	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
+	var login LoginResponse
 	req := LoginRequest{Email: email, HashedPassword: "test"}
-	if err := enc.Encode(req); err != nil {
+	if err := mc.post("/api/v1/login/", req, &login); err != nil {
 		return err
 	}
-	resp, err := mc.httpc.Post(mc.dst+"/api/v1/log_in/", "application/json", &buf)
-	if err != nil {
-		return err
-	}
-	// TODO check response
-	dec := json.NewDecoder(resp.Body)
-	var loginToken LoginToken
-	if err := dec.Decode(&loginToken); err != nil {
+	mc.loginToken = login.LoginToken
+	mc.sessionToken = login.SessionToken
+	mc.refreshToken = login.RefreshToken
+	mc.user = login.User
+	return nil
+}
+
+// Refresh replaces the client's session and refresh tokens with new ones.
+func (mc *mojiClient) Refresh() error {
+	var resp RefreshResponse
+	if err := mc.post("/api/v1/refresh/", RefreshRequest{RefreshToken: mc.refreshToken}, &resp); err != nil {
 		return err
 	}
-	mc.loginToken = loginToken
-	fmt.Println(resp.Status)
+	mc.sessionToken = resp.SessionToken
+	mc.refreshToken = resp.RefreshToken
 	return nil
 }
 
+func (mc *mojiClient) UpdateProfile(req UpdateProfileRequest) (User, error) {
+	req.LoginToken = mc.loginToken
+	var user User
+	if err := mc.post("/api/v1/profile/", req, &user); err != nil {
+		return user, err
+	}
+	mc.user = user
+	return user, nil
+}
+
+func (mc *mojiClient) DeleteAccount() error {
+	req := DeleteAccountRequest{HashedPassword: "test", LoginToken: mc.loginToken}
+	return mc.post("/api/v1/delete_account/", req, nil)
+}
+
+func (mc *mojiClient) Logout(everywhere bool) error {
+	req := LogoutRequest{Everywhere: everywhere, LoginToken: mc.loginToken}
+	return mc.post("/api/v1/logout/", req, nil)
+}
+
+func (mc *mojiClient) SetPushToken(token string) error {
+	req := PushNotifTokenRequest{Kind: AddNotifToken, Token: token, LoginToken: mc.loginToken}
+	return mc.post("/api/v1/push_token/", req, nil)
+}
+
+func (mc *mojiClient) VerifyEmail(op VerifyEmailOp, code string) error {
+	req := VerifyEmailRequest{Kind: op, Code: code, LoginToken: mc.loginToken}
+	return mc.post("/api/v1/verify_email/", req, nil)
+}
+
+func (mc *mojiClient) ResetPassword(email string) error {
+	return mc.post("/api/v1/reset_password/", ResetPasswordRequest{Email: email}, nil)
+}
+
+func (mc *mojiClient) ConfirmResetPassword(email, code, newHashedPassword string) error {
+	req := ConfirmResetPasswordRequest{
+		Email: email, Code: code, NewHashedPassword: newHashedPassword,
+	}
+	return mc.post("/api/v1/confirm_reset_password/", req, nil)
+}
+
 func (mc *mojiClient) FriendOp(to Uuid, op FriendAction) error {
-	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
 	payload := FriendRequest{Other: to, LoginToken: mc.loginToken, Action: op}
-	if err := enc.Encode(payload); err != nil {
-		return err
+	return mc.post("/api/v1/friend/", payload, nil)
+}
+
+func (mc *mojiClient) BlockOp(other Uuid, op BlockOp) (ListBlockedResponse, error) {
+	var out ListBlockedResponse
+	payload := BlockRequest{Kind: op, Other: other, LoginToken: mc.loginToken}
+	if op == ListBlockedOp {
+		return out, mc.post("/api/v1/block/", payload, &out)
 	}
-	resp, err := mc.httpc.Post(mc.dst+"/api/v1/friend/", "application/json", &buf)
-	if err != nil {
-		return err
+	return out, mc.post("/api/v1/block/", payload, nil)
+}
+
+func (mc *mojiClient) Report(kind ReportKind, target Uuid, reason string) error {
+	payload := ReportRequest{Kind: kind, Target: target, Reason: reason, LoginToken: mc.loginToken}
+	return mc.post("/api/v1/report/", payload, nil)
+}
+
+// AdminOp makes a request to the admin API, for a client whose sessionToken is the admin token.
+func (mc *mojiClient) AdminOp(op AdminOp, target Uuid) (ListReportsResponse, error) {
+	var out ListReportsResponse
+	payload := AdminRequest{Kind: op, Target: target}
+	if op == ListReportsOp {
+		return out, mc.post("/api/v1/admin/", payload, &out)
 	}
-	fmt.Println(resp.Status)
-	return nil
+	return out, mc.post("/api/v1/admin/", payload, nil)
+}
+
+func (mc *mojiClient) FriendRequests() (ListFriendRequestsResponse, error) {
+	payload := FriendRequest{LoginToken: mc.loginToken, Action: ListFriendRequests}
+	var resp ListFriendRequestsResponse
+	err := mc.post("/api/v1/friend/", payload, &resp)
+	return resp, err
 }
 
 func (mc *mojiClient) GroupOp(name string, groupUuid Uuid, op GroupOp) error {
-	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
 	payload := GroupRequest{
 		Kind: op, GroupName: name, GroupUuid: groupUuid, LoginToken: mc.loginToken,
 	}
+	return mc.post("/api/v1/groups/", payload, nil)
+}
+
+func (mc *mojiClient) CreateGroup(name string) (Group, error) {
+	var group Group
+	payload := GroupRequest{Kind: CreateGroup, GroupName: name, LoginToken: mc.loginToken}
+	err := mc.post("/api/v1/groups/", payload, &group)
+	return group, err
+}
+
+// JoinGroup joins a group with an optional invite, and returns the group which was joined.
+func (mc *mojiClient) JoinGroup(groupUuid Uuid, inviteCode string) (Group, error) {
+	var group Group
+	payload := GroupRequest{
+		Kind: JoinGroup, GroupUuid: groupUuid, InviteCode: inviteCode, LoginToken: mc.loginToken,
+	}
+	err := mc.post("/api/v1/groups/", payload, &group)
+	return group, err
+}
+
+func (mc *mojiClient) CreateGroupInvite(groupUuid Uuid, maxUses int, ttl int64) (GroupInvite, error) {
+	var invite GroupInvite
+	payload := GroupRequest{
+		Kind: CreateGroupInvite, GroupUuid: groupUuid, InviteMaxUses: maxUses, InviteTTL: ttl,
+		LoginToken: mc.loginToken,
+	}
+	err := mc.post("/api/v1/groups/", payload, &invite)
+	return invite, err
+}
+
+func (mc *mojiClient) ListGroupInvites(groupUuid Uuid) ([]GroupInvite, error) {
+	var resp ListGroupInvitesResponse
+	payload := GroupRequest{Kind: ListGroupInvites, GroupUuid: groupUuid, LoginToken: mc.loginToken}
+	err := mc.post("/api/v1/groups/", payload, &resp)
+	return resp.Invites, err
+}
+
+func (mc *mojiClient) RevokeGroupInvite(groupUuid Uuid, code string) error {
+	payload := GroupRequest{
+		Kind: RevokeGroupInvite, GroupUuid: groupUuid, InviteCode: code, LoginToken: mc.loginToken,
+	}
+	return mc.post("/api/v1/groups/", payload, nil)
+}
+
+func (mc *mojiClient) ListBannedFromGroup(groupUuid Uuid) ([]PublicUser, error) {
+	var resp ListBannedFromGroupResponse
+	payload := GroupRequest{Kind: ListBannedFromGroup, GroupUuid: groupUuid, LoginToken: mc.loginToken}
+	err := mc.post("/api/v1/groups/", payload, &resp)
+	return resp.Banned, err
+}
+
+// UpdateGroupInfo changes the description, emoji or location of a group to those set in req.
+func (mc *mojiClient) UpdateGroupInfo(groupUuid Uuid, req GroupRequest) error {
+	req.Kind = UpdateGroupInfo
+	req.GroupUuid = groupUuid
+	req.LoginToken = mc.loginToken
+	return mc.post("/api/v1/groups/", req, nil)
+}
+
+func (mc *mojiClient) ListJoinRequests(groupUuid Uuid) ([]PublicUser, error) {
+	var resp ListJoinRequestsResponse
+	payload := GroupRequest{Kind: ListJoinRequests, GroupUuid: groupUuid, LoginToken: mc.loginToken}
+	err := mc.post("/api/v1/groups/", payload, &resp)
+	return resp.Requests, err
+}
+
+// GroupMemberOp kicks, bans, promotes or demotes another member of a group, or answers their
+// request to join it.
+func (mc *mojiClient) GroupMemberOp(groupUuid, other Uuid, op GroupOp) error {
+	payload := GroupRequest{Kind: op, GroupUuid: groupUuid, Other: other, LoginToken: mc.loginToken}
+	return mc.post("/api/v1/groups/", payload, nil)
+}
+
+// post sends payload as JSON to path, and decodes the response into out if it is not nil.
+func (mc *mojiClient) post(path string, payload, out interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
 	if err := enc.Encode(payload); err != nil {
 		return err
 	}
-	resp, err := mc.httpc.Post(mc.dst+"/api/v1/groups/", "application/json", &buf)
+	req, err := http.NewRequest(http.MethodPost, mc.dst+path, &buf)
 	if err != nil {
 		return err
 	}
-	fmt.Println(resp.Status)
-	return nil
+	req.Header.Set("Content-Type", "application/json")
+	if mc.sessionToken != "" {
+		req.Header.Set("Authorization", "Bearer "+mc.sessionToken)
+	}
+	resp, err := mc.httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	dec := json.NewDecoder(resp.Body)
+	return dec.Decode(out)
+}
+
+func (mc *mojiClient) SendMsg(to Uuid, kind MessageRecipientKind, msg Message) error {
+	payload := SendMessageRequest{
+		LoginToken: mc.loginToken, Message: msg, RecipientKind: kind, To: to,
+	}
+	return mc.post("/api/v1/send_msg/", payload, nil)
+}
+
+func (mc *mojiClient) RecvMsg(deleteOld bool) (RecvMsgResponse, error) {
+	var out RecvMsgResponse
+	payload := RecvMsgRequest{LoginToken: mc.loginToken, DeleteOld: deleteOld}
+	err := mc.post("/api/v1/recv_msg/", payload, &out)
+	return out, err
+}
+
+func (mc *mojiClient) AckMsg(msgID Uuid, reply EmojiReply) error {
+	payload := AckMsgRequest{MsgID: msgID, Reply: reply, LoginToken: mc.loginToken}
+	return mc.post("/api/v1/ack_msg/", payload, nil)
+}
+
+func (mc *mojiClient) SessionOp(op SessionOp, session Uuid) (ListSessionsResponse, error) {
+	var out ListSessionsResponse
+	payload := SessionRequest{Kind: op, Session: session, LoginToken: mc.loginToken}
+	if op == ListSessions {
+		return out, mc.post("/api/v1/sessions/", payload, &out)
+	}
+	return out, mc.post("/api/v1/sessions/", payload, nil)
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var (
+	errInvalidEmailCode  = errors.New("Code is incorrect or has expired")
+	errEmailCodeCooldown = errors.New("A code was sent recently, wait before asking for another")
+)
+
+// How many wrong codes may be tried before an emailed code stops working.
+const maxEmailCodeAttempts = 5
+
+// Number of digits in an emailed code.
+const emailCodeDigits = 8
+
+// How long after a code is issued until another of the same kind can be, so that users cannot be
+// flooded with emails and guesses at a code cannot be reset by asking for a new one.
+const emailCodeCooldown = time.Minute
+
+// Generates a code to be emailed, which is short enough to type in by hand.
+func generateEmailCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < emailCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", emailCodeDigits, n), nil
+}
+
+// Creates a new code of kind for user which is valid for duration, replacing any earlier one,
+// or returns errEmailCodeCooldown if the earlier one was issued too recently. The code is
+// returned so that it can be emailed, and only its hash is kept.
+func (s *Server) issueEmailCode(ctx context.Context, kind EmailCodeKind, user Uuid, duration time.Duration) (string, error) {
+	defer s.emailCodeLocks.Lock(user)()
+	existing, err := s.GetEmailCode(ctx, kind, user)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if existing != nil && !existing.Expired() &&
+		now.Before(time.Unix(existing.IssuedAt, 0).Add(emailCodeCooldown)) {
+		return "", errEmailCodeCooldown
+	}
+	code, err := generateEmailCode()
+	if err != nil {
+		return "", err
+	}
+	err = s.SetEmailCode(ctx, kind, &EmailCode{
+		User:       user,
+		CodeHash:   hashSecret(code),
+		IssuedAt:   now.Unix(),
+		ValidUntil: now.Add(duration).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Checks code against the code of kind emailed to user, deleting it if it matches so that it
+// cannot be used again. Too many wrong attempts also delete it, so that it cannot be guessed.
+func (s *Server) useEmailCode(ctx context.Context, kind EmailCodeKind, user Uuid, code string) error {
+	defer s.emailCodeLocks.Lock(user)()
+	existing, err := s.GetEmailCode(ctx, kind, user)
+	if err != nil {
+		return err
+	} else if existing == nil || existing.Expired() {
+		return errInvalidEmailCode
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(code)), []byte(existing.CodeHash)) == 1 {
+		return s.DeleteEmailCode(ctx, kind, user)
+	}
+	existing.Attempts++
+	if existing.Attempts >= maxEmailCodeAttempts {
+		err = s.DeleteEmailCode(ctx, kind, user)
+	} else {
+		err = s.SetEmailCode(ctx, kind, existing)
+	}
+	if err != nil {
+		return err
+	}
+	return errInvalidEmailCode
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errNoFriendRequest = errors.New("No such friend request")
+
+// Asks for user to be friends with other, who is sent a push notification about it. If other
+// already asked to be friends with user, they instead become friends right away, which is
+// returned.
+func (s *Server) sendFriendRequest(ctx context.Context, user *User, other Uuid) (bool, error) {
+	defer s.friendLocks.LockPair(user.Uuid, other)()
+	if blocked, err := s.blockedBetween(ctx, user.Uuid, other); err != nil {
+		return false, err
+	} else if blocked {
+		return false, errBlocked
+	}
+	if isFriend, err := s.IsFriend(ctx, user.Uuid, other); err != nil || isFriend {
+		return isFriend, err
+	}
+	requested, err := s.HasFriendRequest(ctx, other, user.Uuid)
+	if err != nil {
+		return false, err
+	} else if requested {
+		return true, s.makeFriends(ctx, other, user.Uuid)
+	}
+	if err = s.AddFriendRequest(ctx, user.Uuid, other, time.Now().Unix()); err != nil {
+		return false, err
+	}
+	go s.sendFriendRequestPushNotification(other, user.Name)
+	return false, nil
+}
+
+// Makes user and other friends if other asked to be.
+func (s *Server) acceptFriendRequest(ctx context.Context, user, other Uuid) error {
+	defer s.friendLocks.LockPair(user, other)()
+	requested, err := s.HasFriendRequest(ctx, other, user)
+	if err != nil {
+		return err
+	} else if !requested {
+		return errNoFriendRequest
+	}
+	if blocked, err := s.blockedBetween(ctx, user, other); err != nil {
+		return err
+	} else if blocked {
+		return errBlocked
+	}
+	return s.makeFriends(ctx, other, user)
+}
+
+// Removes a friend request, either declined by to or cancelled by from.
+func (s *Server) deleteFriendRequest(ctx context.Context, from, to Uuid) error {
+	defer s.friendLocks.LockPair(from, to)()
+	requested, err := s.HasFriendRequest(ctx, from, to)
+	if err != nil {
+		return err
+	} else if !requested {
+		return errNoFriendRequest
+	}
+	return s.DeleteFriendRequest(ctx, from, to)
+}
+
+// Ends the friendship between user and other, along with any requests between them.
+func (s *Server) removeFriend(ctx context.Context, user, other Uuid) error {
+	defer s.friendLocks.LockPair(user, other)()
+	return s.unfriend(ctx, user, other)
+}
+
+// Same as removeFriend, but the lock for user and other must be held.
+func (s *Server) unfriend(ctx context.Context, user, other Uuid) error {
+	for _, pair := range [][2]Uuid{{user, other}, {other, user}} {
+		if err := s.RemoveFriend(ctx, pair[0], pair[1]); err != nil {
+			return err
+		}
+		if err := s.DeleteFriendRequest(ctx, pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes from and to friends of each other, after to accepted the request from from. The lock
+// for them must be held.
+func (s *Server) makeFriends(ctx context.Context, from, to Uuid) error {
+	if err := s.AddFriend(ctx, from, to); err != nil {
+		return err
+	}
+	if err := s.AddFriend(ctx, to, from); err != nil {
+		return err
+	}
+	// A request in the other direction is answered as well.
+	if err := s.DeleteFriendRequest(ctx, to, from); err != nil {
+		return err
+	}
+	return s.DeleteFriendRequest(ctx, from, to)
+}
+
+// Returns whether the DMPolicy of recipient allows sender to send them direct messages.
+func (s *Server) acceptsMessagesFrom(ctx context.Context, recipient *User, sender Uuid) (bool, error) {
+	switch recipient.DirectMessages {
+	case DMEveryone:
+		return true, nil
+	case DMFriends:
+		return s.IsFriend(ctx, recipient.Uuid, sender)
+	case DMFriendsOfFriends:
+		friends, err := s.ListFriends(ctx, recipient.Uuid)
+		if err != nil {
+			return false, err
+		}
+		for _, friend := range friends {
+			if friend == sender {
+				return true, nil
+			}
+		}
+		for _, friend := range friends {
+			if isFriend, err := s.IsFriend(ctx, friend, sender); err != nil || isFriend {
+				return isFriend, err
+			}
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("Unknown direct message policy %v", recipient.DirectMessages)
+	}
+}
+
+// Returns the users with the given uuids, skipping any which no longer exist.
+func (s *Server) usersFor(ctx context.Context, uuids []Uuid) ([]PublicUser, error) {
+	out := make([]PublicUser, 0, len(uuids))
+	for _, uuid := range uuids {
+		user, err := s.GetUser(ctx, uuid)
+		if err != nil {
+			return nil, err
+		} else if user == nil {
+			continue
+		}
+		out = append(out, user.Public())
+	}
+	return out, nil
+}
+
+func (s *Server) sendFriendRequestPushNotification(to Uuid, name string) {
+	tokens := s.notifTokensFor(context.Background(), InvalidUuid, []Uuid{to})
+	if len(tokens) == 0 {
+		return
+	}
+	sendPush(tokens, "🤝❓", fmt.Sprintf("👋 %s ➡️🤝❓", name))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFriendRequests(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		_, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 3)
+		alice, bob, carol := clients[0], clients[1], clients[2]
+		ctx := context.Background()
+		areFriends := func(a, b *mojiClient) bool {
+			ab, _ := store.IsFriend(ctx, a.UserID(), b.UserID())
+			ba, _ := store.IsFriend(ctx, b.UserID(), a.UserID())
+			if ab != ba {
+				t.Errorf("Friendship between %v and %v is one sided", a.user.Name, b.user.Name)
+			}
+			return ab
+		}
+
+		if err := alice.FriendOp(bob.UserID(), AddFriend); err != nil {
+			t.Fatal(err)
+		}
+		if areFriends(alice, bob) {
+			t.Fatal("Became friends without accepting")
+		}
+		reqs, err := bob.FriendRequests()
+		if err != nil || len(reqs.Incoming) != 1 || reqs.Incoming[0].Uuid != alice.UserID() {
+			t.Fatalf("Got requests %v, want one from alice: %v", reqs, err)
+		}
+		reqs, err = alice.FriendRequests()
+		if err != nil || len(reqs.Outgoing) != 1 || reqs.Outgoing[0].Uuid != bob.UserID() {
+			t.Fatalf("Got requests %v, want one to bob: %v", reqs, err)
+		}
+		if err = alice.FriendOp(bob.UserID(), AcceptFriend); err == nil {
+			t.Error("Accepted a request which was sent, not received")
+		}
+		if err = bob.FriendOp(alice.UserID(), AcceptFriend); err != nil {
+			t.Fatal(err)
+		}
+		if !areFriends(alice, bob) {
+			t.Error("Not friends after accepting")
+		}
+		if reqs, _ = bob.FriendRequests(); len(reqs.Incoming) != 0 {
+			t.Errorf("Request %v was kept after accepting", reqs)
+		}
+
+		// Declining and cancelling.
+		if err = carol.FriendOp(alice.UserID(), AddFriend); err != nil {
+			t.Fatal(err)
+		}
+		if err = alice.FriendOp(carol.UserID(), DeclineFriend); err != nil {
+			t.Fatal(err)
+		}
+		if areFriends(alice, carol) {
+			t.Error("Became friends after declining")
+		}
+		if err = carol.FriendOp(alice.UserID(), AddFriend); err != nil {
+			t.Fatal(err)
+		}
+		if err = carol.FriendOp(alice.UserID(), CancelFriend); err != nil {
+			t.Fatal(err)
+		}
+		if err = alice.FriendOp(carol.UserID(), AcceptFriend); err == nil {
+			t.Error("Accepted a cancelled request")
+		}
+
+		// Asking someone who already asked is accepting.
+		if err = carol.FriendOp(bob.UserID(), AddFriend); err != nil {
+			t.Fatal(err)
+		}
+		if err = bob.FriendOp(carol.UserID(), AddFriend); err != nil {
+			t.Fatal(err)
+		}
+		if !areFriends(bob, carol) {
+			t.Error("Not friends after both asking")
+		}
+
+		if err = alice.FriendOp(bob.UserID(), Rmfriend); err != nil {
+			t.Fatal(err)
+		}
+		if areFriends(alice, bob) {
+			t.Error("Still friends after removing")
+		}
+		if err = alice.FriendOp(Uuid(12345), AddFriend); err == nil {
+			t.Error("Asked a user who does not exist to be friends")
+		}
+	})
+}
+
+func TestDirectMessagePolicy(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		_, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 3)
+		alice, bob, carol := clients[0], clients[1], clients[2]
+		befriend := func(a, b *mojiClient) {
+			if err := a.FriendOp(b.UserID(), AddFriend); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.FriendOp(a.UserID(), AcceptFriend); err != nil {
+				t.Fatal(err)
+			}
+		}
+		setPolicy := func(c *mojiClient, policy DMPolicy) {
+			if _, err := c.UpdateProfile(UpdateProfileRequest{DirectMessages: &policy}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg := Message{Emojis: "🍕🍔🌯", SentAt: time.Now().Unix(), TTL: 60, LocalTime: 12}
+		// alice - bob - carol
+		befriend(alice, bob)
+		befriend(bob, carol)
+
+		if err := carol.SendMsg(alice.UserID(), MsgFriend, msg); err != nil {
+			t.Errorf("Everyone can message by default: %v", err)
+		}
+
+		setPolicy(alice, DMFriends)
+		if err := carol.SendMsg(alice.UserID(), MsgFriend, msg); err == nil {
+			t.Error("Stranger messaged someone only accepting friends")
+		}
+		if err := bob.SendMsg(alice.UserID(), MsgFriend, msg); err != nil {
+			t.Errorf("Friend could not message: %v", err)
+		}
+
+		setPolicy(alice, DMFriendsOfFriends)
+		if err := carol.SendMsg(alice.UserID(), MsgFriend, msg); err != nil {
+			t.Errorf("Friend of friend could not message: %v", err)
+		}
+		if err := bob.FriendOp(carol.UserID(), Rmfriend); err != nil {
+			t.Fatal(err)
+		}
+		if err := carol.SendMsg(alice.UserID(), MsgFriend, msg); err == nil {
+			t.Error("Stranger messaged someone only accepting friends of friends")
+		}
+
+		invalid := DMPolicy(42)
+		if _, err := alice.UpdateProfile(UpdateProfileRequest{DirectMessages: &invalid}); err == nil {
+			t.Error("Set an unknown direct message policy")
+		}
+	})
+}
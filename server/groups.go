@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+const (
+	maxGroupDescriptionLength = 280
+	// Emojis can be made up of several runes, such as flags or families.
+	maxGroupEmojiLength = 16
+	// How far away groups are listed from a location when no distance is given.
+	defaultNearbyKm = 25
+	// Most members a group can have when MOJI_MAX_GROUP_SIZE is not set.
+	defaultMaxGroupSize = 256
+)
+
+var (
+	errNoGroup         = errors.New("No such group")
+	errNotGroupMember  = errors.New("Not a member of the group")
+	errNotGroupAdmin   = errors.New("Only admins of the group can do that")
+	errNotGroupOwner   = errors.New("Only the owner of the group can do that")
+	errGroupLocked     = errors.New("Group is locked")
+	errGroupFull       = errors.New("Group is full")
+	errBannedFromGroup = errors.New("Banned from the group")
+)
+
+// Reads the most members any group can have from MOJI_MAX_GROUP_SIZE.
+func maxGroupSizeFromEnv() int {
+	env := os.Getenv("MOJI_MAX_GROUP_SIZE")
+	if env == "" {
+		return defaultMaxGroupSize
+	}
+	size, err := strconv.Atoi(env)
+	if err != nil || size < 1 {
+		fmt.Printf("Invalid MOJI_MAX_GROUP_SIZE %q, using %d\n", env, defaultMaxGroupSize)
+		return defaultMaxGroupSize
+	}
+	return size
+}
+
+// Returns the most members group can have, which is its own limit unless the server allows fewer.
+func (s *Server) groupSizeLimit(group *Group) int {
+	limit := s.MaxGroupSize
+	if limit == 0 {
+		limit = defaultMaxGroupSize
+	}
+	if group.MemberLimit > 0 && group.MemberLimit < limit {
+		return group.MemberLimit
+	}
+	return limit
+}
+
+// Locks a group which is set to lock once it is full, if it is full.
+func (s *Server) lockIfFull(group *Group) {
+	if group.LockWhenFull && len(group.Users) >= s.groupSizeLimit(group) {
+		group.Locked = true
+	}
+}
+
+// Adds user to a group, which needs an invite if it is locked. The group can be left out if there
+// is an invite, in which case it is the one the invite is for. Returns the group with them in it.
+func (s *Server) joinGroup(ctx context.Context, user *User, groupUuid Uuid, inviteCode string) (*Group, error) {
+	if groupUuid == InvalidUuid && inviteCode != "" {
+		invite, err := s.GetGroupInvite(ctx, normalizeInviteCode(inviteCode))
+		if err != nil {
+			return nil, err
+		} else if invite == nil {
+			return nil, errInvalidInvite
+		}
+		groupUuid = invite.Group
+	}
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return nil, err
+	} else if group == nil {
+		return nil, errNoGroup
+	}
+	if group.IsMember(user.Uuid) {
+		return group, nil
+	}
+	var invite *GroupInvite
+	if group.Locked {
+		if inviteCode == "" {
+			return nil, errGroupLocked
+		}
+		if invite, err = s.groupInviteFor(ctx, group, inviteCode); err != nil {
+			return nil, err
+		}
+	}
+	if err = s.addToGroup(ctx, group, user); err != nil {
+		return nil, err
+	}
+	// Only used up once the user has joined, so that failing to join does not waste it.
+	if invite != nil {
+		if err = s.useGroupInvite(ctx, invite); err != nil {
+			return nil, err
+		}
+	}
+	return group, nil
+}
+
+// Adds user to group and saves it, dropping any request they made to join it. The lock for the
+// group must be held.
+func (s *Server) addToGroup(ctx context.Context, group *Group, user *User) error {
+	if len(group.Users) >= s.groupSizeLimit(group) {
+		return errGroupFull
+	}
+	if banned, err := s.IsBannedFromGroup(ctx, group.Uuid, user.Uuid); err != nil {
+		return err
+	} else if banned {
+		return errBannedFromGroup
+	}
+	group.Users[user.Uuid] = user.Name
+	s.lockIfFull(group)
+	if err := s.AddGroup(ctx, group); err != nil {
+		return err
+	}
+	if err := s.AddUserToGroup(ctx, user.Uuid, group.Uuid); err != nil {
+		return err
+	}
+	return s.DeleteJoinRequest(ctx, group.Uuid, user.Uuid)
+}
+
+// Returns whether name is between 3 and maxNameLength characters, as group names must be.
+func validGroupName(name string) bool {
+	n := utf8.RuneCountInString(name)
+	return n >= 3 && n <= maxNameLength
+}
+
+// Checks the description, emoji, location and limits in a request to create or update a group.
+func (s *Server) validateGroupInfo(req *GroupRequest) error {
+	if req.MemberLimit != nil {
+		if max := s.groupSizeLimit(&Group{}); *req.MemberLimit < 0 || *req.MemberLimit > max {
+			return fmt.Errorf("Member limit must be between 0 and %d", max)
+		}
+	}
+	if req.Description != nil && utf8.RuneCountInString(*req.Description) > maxGroupDescriptionLength {
+		return fmt.Errorf("Description must be at most %d characters", maxGroupDescriptionLength)
+	}
+	if req.Emoji != nil {
+		if n := utf8.RuneCountInString(string(*req.Emoji)); n == 0 || n > maxGroupEmojiLength {
+			return fmt.Errorf("Emoji must be between 1 and %d characters", maxGroupEmojiLength)
+		}
+	}
+	if req.Location != nil {
+		if !req.Location.IsValid() {
+			return fmt.Errorf("Location must have a latitude within 90 and longitude within 180")
+		} else if utf8.RuneCountInString(req.Location.Label) > maxNameLength {
+			return fmt.Errorf("Location label must be at most %d characters", maxNameLength)
+		}
+	}
+	return nil
+}
+
+// Sets the description, emoji, location and limits of a group which are set in a request.
+func (s *Server) applyGroupInfo(group *Group, req *GroupRequest) {
+	if req.MemberLimit != nil {
+		group.MemberLimit = *req.MemberLimit
+	}
+	if req.LockWhenFull != nil {
+		group.LockWhenFull = *req.LockWhenFull
+	}
+	s.lockIfFull(group)
+	if req.Description != nil {
+		group.Description = *req.Description
+	}
+	if req.Emoji != nil {
+		group.Emoji = *req.Emoji
+	}
+	if req.ClearLocation {
+		group.Location = nil
+	}
+	if req.Location != nil {
+		location := *req.Location
+		group.Location = &location
+	}
+}
+
+// Applies update to the latest version of a group and saves it, returning the updated group.
+func (s *Server) updateGroup(ctx context.Context, groupUuid Uuid, update func(*Group) error) (*Group, error) {
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return nil, err
+	} else if group == nil {
+		return nil, errNoGroup
+	}
+	if err = update(group); err != nil {
+		return nil, err
+	}
+	return group, s.AddGroup(ctx, group)
+}
+
+// Removes user from a group, deleting the group once nobody is left in it. Returns the group as
+// it was left, or nil if it did not exist.
+func (s *Server) leaveGroup(ctx context.Context, user, groupUuid Uuid) (*Group, error) {
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil || group == nil {
+		return nil, err
+	}
+	if !group.IsMember(user) {
+		// The user may only be left in the set of members if saving the group failed part way.
+		member, err := s.UserIsMemberOfGroup(ctx, user, groupUuid)
+		if err != nil {
+			return nil, err
+		} else if !member {
+			return nil, errNotGroupMember
+		}
+	}
+	return group, s.removeFromGroup(ctx, group, user)
+}
+
+// Removes member from a group on behalf of admin, and bans them from joining it again if ban is
+// set. Anyone can be banned, but only members can be kicked. Returns the group as it was left,
+// and whether member was removed from it.
+func (s *Server) kickFromGroup(ctx context.Context, admin, member, groupUuid Uuid, ban bool) (*Group, bool, error) {
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return nil, false, err
+	} else if group == nil {
+		return nil, false, errNoGroup
+	}
+	if !group.IsAdmin(admin) {
+		return nil, false, errNotGroupAdmin
+	} else if !ban && !group.IsMember(member) {
+		return nil, false, errNotGroupMember
+	}
+	// Admins cannot kick each other, so that only the owner decides who runs the group.
+	if member == group.Owner || (group.Admins[member] && admin != group.Owner) {
+		return nil, false, errNotGroupOwner
+	}
+	if ban {
+		if err = s.BanFromGroup(ctx, groupUuid, member); err != nil {
+			return nil, false, err
+		}
+		if err = s.DeleteJoinRequest(ctx, groupUuid, member); err != nil {
+			return nil, false, err
+		}
+		if !group.IsMember(member) {
+			return group, false, nil
+		}
+	}
+	return group, true, s.removeFromGroup(ctx, group, member)
+}
+
+// Lets a banned user join a group again, on behalf of one of its admins.
+func (s *Server) unbanFromGroup(ctx context.Context, admin, user, groupUuid Uuid) error {
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return err
+	} else if group == nil {
+		return errNoGroup
+	} else if !group.IsAdmin(admin) {
+		return errNotGroupAdmin
+	}
+	return s.UnbanFromGroup(ctx, groupUuid, user)
+}
+
+// Returns who is banned from a group, which only its admins can see.
+func (s *Server) bannedFromGroup(ctx context.Context, admin, groupUuid Uuid) ([]PublicUser, error) {
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return nil, err
+	} else if group == nil {
+		return nil, errNoGroup
+	} else if !group.IsAdmin(admin) {
+		return nil, errNotGroupAdmin
+	}
+	uuids, err := s.BannedFromGroup(ctx, groupUuid)
+	if err != nil {
+		return nil, err
+	}
+	return s.usersFor(ctx, uuids)
+}
+
+// Tells user they were kicked or banned from a group.
+func (s *Server) sendRemovedFromGroupPushNotification(group *Group, user Uuid, banned bool) {
+	tokens := s.notifTokensFor(context.Background(), InvalidUuid, []Uuid{user})
+	if len(tokens) == 0 {
+		return
+	}
+	body := fmt.Sprintf("👢 %s", group.Name)
+	if banned {
+		body = fmt.Sprintf("🚫 %s", group.Name)
+	}
+	sendPush(tokens, "👥➖", body)
+}
+
+// Removes user from group and saves it, passing ownership on if they owned it. The lock for the
+// group must be held.
+func (s *Server) removeFromGroup(ctx context.Context, group *Group, user Uuid) error {
+	delete(group.Users, user)
+	delete(group.Admins, user)
+	if err := s.DeleteUserFromGroup(ctx, user, group.Uuid); err != nil {
+		return err
+	}
+	if len(group.Users) == 0 {
+		return s.DeleteGroup(ctx, group.Uuid)
+	}
+	if group.Owner == user {
+		group.Owner = nextGroupOwner(group)
+		delete(group.Admins, group.Owner)
+	}
+	return s.AddGroup(ctx, group)
+}
+
+// Adds the members of every group to the groups listed for them, since groups were only listed
+// for their members once accounts could be deleted.
+func (s *Server) indexGroupMembers(ctx context.Context) error {
+	groups, err := s.GetGroups(ctx)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		members, err := s.UsersInGroup(ctx, group.Uuid)
+		if err != nil {
+			return err
+		}
+		for user := range group.Users {
+			members = append(members, user)
+		}
+		for _, user := range members {
+			if err = s.AddUserToGroup(ctx, user, group.Uuid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Gives every group created before groups had owners one, in the same way as when an owner
+// leaves, so that no group is left without anyone to administer it.
+func (s *Server) assignGroupOwners(ctx context.Context) error {
+	groups, err := s.GetGroups(ctx)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if group.Owner != InvalidUuid || len(group.Users) == 0 {
+			continue
+		}
+		if err = s.assignGroupOwner(ctx, group.Uuid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) assignGroupOwner(ctx context.Context, groupUuid Uuid) error {
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil || group == nil || group.Owner != InvalidUuid || len(group.Users) == 0 {
+		return err
+	}
+	group.Owner = nextGroupOwner(group)
+	delete(group.Admins, group.Owner)
+	return s.AddGroup(ctx, group)
+}
+
+// Returns who should own a group after its owner leaves, which is one of its admins if there are
+// any, or otherwise any member. Uuids are compared so that the choice is stable.
+func nextGroupOwner(group *Group) Uuid {
+	candidates := make([]Uuid, 0, len(group.Users))
+	for uuid := range group.Admins {
+		candidates = append(candidates, uuid)
+	}
+	if len(candidates) == 0 {
+		for uuid := range group.Users {
+			candidates = append(candidates, uuid)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+	return candidates[0]
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupRoles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 4)
+		owner, admin, member, outsider := clients[0], clients[1], clients[2], clients[3]
+		ctx := context.Background()
+
+		for _, name := range []string{"ab", strings.Repeat("a", maxNameLength+1)} {
+			if _, err := owner.CreateGroup(name); err == nil {
+				t.Errorf("Created a group named %q", name)
+			}
+		}
+		// Names are measured in characters rather than bytes.
+		if _, err := owner.CreateGroup(strings.Repeat("🎉", maxNameLength)); err != nil {
+			t.Errorf("Could not create a group named with %d emojis: %v", maxNameLength, err)
+		}
+		group, err := owner.CreateGroup("roles")
+		if err != nil {
+			t.Fatal(err)
+		} else if group.Owner != owner.UserID() {
+			t.Fatalf("Group is owned by %v, want its creator %v", group.Owner, owner.UserID())
+		}
+		for _, c := range []*mojiClient{admin, member} {
+			if err = c.GroupOp("", group.Uuid, JoinGroup); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err = outsider.GroupOp("", group.Uuid, SwitchLockGroup); err == nil {
+			t.Error("Non-member locked a group")
+		}
+		if err = outsider.GroupOp("", group.Uuid, LeaveGroup); err == nil {
+			t.Error("Non-member left a group")
+		}
+		if err = member.GroupOp("", group.Uuid, SwitchLockGroup); err == nil {
+			t.Error("Member who is not an admin locked a group")
+		}
+		if err = member.GroupMemberOp(group.Uuid, member.UserID(), PromoteInGroup); err == nil {
+			t.Error("Member promoted themselves")
+		}
+		if err = owner.GroupMemberOp(group.Uuid, admin.UserID(), PromoteInGroup); err != nil {
+			t.Fatal(err)
+		}
+		if err = admin.GroupOp("renamed", group.Uuid, RenameGroup); err != nil {
+			t.Errorf("Admin could not rename group: %v", err)
+		}
+		if err = admin.GroupOp("", group.Uuid, SwitchLockGroup); err != nil {
+			t.Errorf("Admin could not lock group: %v", err)
+		}
+		if err = outsider.GroupOp("", group.Uuid, JoinGroup); err == nil {
+			t.Error("Joined a locked group")
+		}
+		if err = admin.GroupMemberOp(group.Uuid, owner.UserID(), KickFromGroup); err == nil {
+			t.Error("Admin kicked the owner")
+		}
+		if err = admin.GroupMemberOp(group.Uuid, member.UserID(), KickFromGroup); err != nil {
+			t.Errorf("Admin could not kick member: %v", err)
+		}
+
+		got, err := s.GetGroup(ctx, group.Uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != "renamed" || !got.Locked || got.IsMember(member.UserID()) {
+			t.Errorf("Unexpected group after admin ops %+v", got)
+		}
+		if isMember, err := s.UserIsMemberOfGroup(ctx, member.UserID(), group.Uuid); err != nil || isMember {
+			t.Errorf("Kicked member is still in the group: %v", err)
+		}
+
+		if err = owner.GroupOp("", group.Uuid, LeaveGroup); err != nil {
+			t.Fatal(err)
+		}
+		if got, err = s.GetGroup(ctx, group.Uuid); err != nil {
+			t.Fatal(err)
+		} else if got.Owner != admin.UserID() || got.Admins[admin.UserID()] {
+			t.Errorf("Group was passed on to %v, want its admin %v", got.Owner, admin.UserID())
+		}
+	})
+}
+
+func TestAssignGroupOwners(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 2)
+		ctx := context.Background()
+
+		group, err := clients[0].CreateGroup("legacy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = clients[1].GroupOp("", group.Uuid, JoinGroup); err != nil {
+			t.Fatal(err)
+		}
+		// Groups created before groups had owners have none.
+		legacy, err := s.GetGroup(ctx, group.Uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy.Owner = InvalidUuid
+		if err = s.AddGroup(ctx, legacy); err != nil {
+			t.Fatal(err)
+		}
+		if err = clients[1].GroupOp("", group.Uuid, SwitchLockGroup); err == nil {
+			t.Error("Member of a group without an owner locked it")
+		}
+
+		if err = s.assignGroupOwners(ctx); err != nil {
+			t.Fatal(err)
+		}
+		want := clients[0].UserID()
+		if clients[1].UserID() < want {
+			want = clients[1].UserID()
+		}
+		if got, err := s.GetGroup(ctx, group.Uuid); err != nil {
+			t.Fatal(err)
+		} else if got.Owner != want {
+			t.Errorf("Group without an owner was given to %v, want %v", got.Owner, want)
+		}
+	})
+}
+
+func TestGroupInvites(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 4)
+		owner, alice, bob, carol := clients[0], clients[1], clients[2], clients[3]
+		ctx := context.Background()
+
+		group, err := owner.CreateGroup("invite only")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = owner.GroupOp("", group.Uuid, SwitchLockGroup); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = alice.CreateGroupInvite(group.Uuid, 0, 0); err == nil {
+			t.Error("Non-member created an invite")
+		}
+		single, err := owner.CreateGroupInvite(group.Uuid, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		multi, err := owner.CreateGroupInvite(group.Uuid, 0, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invites, err := owner.ListGroupInvites(group.Uuid); err != nil {
+			t.Fatal(err)
+		} else if len(invites) != 2 {
+			t.Errorf("Got %d invites, want 2", len(invites))
+		}
+
+		if _, err = alice.JoinGroup(group.Uuid, ""); err == nil {
+			t.Error("Joined a locked group without an invite")
+		}
+		if _, err = alice.JoinGroup(group.Uuid, "WRONG"); err == nil {
+			t.Error("Joined a locked group with a wrong invite")
+		}
+		// Failing to join does not use up an invite.
+		if err = owner.GroupMemberOp(group.Uuid, carol.UserID(), BanFromGroupOp); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = carol.JoinGroup(group.Uuid, single.Code); err == nil {
+			t.Error("Banned user joined with an invite")
+		}
+		if err = owner.GroupMemberOp(group.Uuid, carol.UserID(), UnbanFromGroupOp); err != nil {
+			t.Fatal(err)
+		}
+		// The group is found from the invite alone, and codes are not case sensitive.
+		joined, err := alice.JoinGroup(InvalidUuid, strings.ToLower(single.Code))
+		if err != nil {
+			t.Fatal(err)
+		} else if joined.Uuid != group.Uuid {
+			t.Errorf("Joined group %v, want %v", joined.Uuid, group.Uuid)
+		}
+		if _, err = bob.JoinGroup(group.Uuid, single.Code); err == nil {
+			t.Error("Used a single use invite twice")
+		}
+		if _, err = bob.JoinGroup(group.Uuid, multi.Code); err != nil {
+			t.Errorf("Could not join with a multi use invite: %v", err)
+		}
+
+		if err = alice.RevokeGroupInvite(group.Uuid, multi.Code); err == nil {
+			t.Error("Member who is not an admin revoked an invite")
+		}
+		if err = owner.RevokeGroupInvite(group.Uuid, multi.Code); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = carol.JoinGroup(group.Uuid, multi.Code); err == nil {
+			t.Error("Joined with a revoked invite")
+		}
+		if invites, err := owner.ListGroupInvites(group.Uuid); err != nil {
+			t.Fatal(err)
+		} else if len(invites) != 0 {
+			t.Errorf("Got %d invites after using and revoking them, want 0", len(invites))
+		}
+
+		expired := GroupInvite{Code: "EXPIRED", Group: group.Uuid, ValidUntil: time.Now().Add(-time.Minute).Unix()}
+		if err = s.AddGroupInvite(ctx, &expired); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = carol.JoinGroup(group.Uuid, expired.Code); err == nil {
+			t.Error("Joined with an expired invite")
+		}
+	})
+}
+
+func TestJoinRequests(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 4)
+		owner, member, alice, bob := clients[0], clients[1], clients[2], clients[3]
+		ctx := context.Background()
+
+		group, err := owner.CreateGroup("exclusive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = alice.GroupOp("", group.Uuid, RequestToJoinGroup); err == nil {
+			t.Error("Asked to join a group which is not locked")
+		}
+		if err = member.GroupOp("", group.Uuid, JoinGroup); err != nil {
+			t.Fatal(err)
+		}
+		if err = owner.GroupOp("", group.Uuid, SwitchLockGroup); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []*mojiClient{alice, bob, alice} {
+			if err = c.GroupOp("", group.Uuid, RequestToJoinGroup); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err = member.ListJoinRequests(group.Uuid); err == nil {
+			t.Error("Member who is not an admin listed join requests")
+		}
+		requests, err := owner.ListJoinRequests(group.Uuid)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 2 {
+			t.Fatalf("Got %d join requests, want one each from alice and bob", len(requests))
+		}
+		for _, c := range []*mojiClient{alice, bob} {
+			if requested, err := s.HasJoinRequest(ctx, group.Uuid, c.UserID()); err != nil || !requested {
+				t.Errorf("%s has not asked to join: %v", c.user.Name, err)
+			}
+		}
+
+		if err = member.GroupMemberOp(group.Uuid, alice.UserID(), ApproveJoinRequest); err == nil {
+			t.Error("Member who is not an admin approved a join request")
+		}
+		if err = owner.GroupMemberOp(group.Uuid, alice.UserID(), ApproveJoinRequest); err != nil {
+			t.Fatal(err)
+		}
+		if err = owner.GroupMemberOp(group.Uuid, bob.UserID(), RejectJoinRequest); err != nil {
+			t.Fatal(err)
+		}
+		if err = owner.GroupMemberOp(group.Uuid, bob.UserID(), ApproveJoinRequest); err == nil {
+			t.Error("Approved a join request which was already rejected")
+		}
+
+		got, err := s.GetGroup(ctx, group.Uuid)
+		if err != nil {
+			t.Fatal(err)
+		} else if !got.IsMember(alice.UserID()) || got.IsMember(bob.UserID()) {
+			t.Errorf("Unexpected members after answering join requests %v", got.Users)
+		}
+		if requests, err = owner.ListJoinRequests(group.Uuid); err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 0 {
+			t.Errorf("Got %d join requests after answering them all, want 0", len(requests))
+		}
+	})
+}
+
+func TestGroupInfo(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 2)
+		owner, member := clients[0], clients[1]
+		ctx := context.Background()
+
+		places := []struct {
+			name     string
+			location GeoLocation
+		}{
+			{"san francisco", GeoLocation{Latitude: 37.7749, Longitude: -122.4194, Label: "SF"}},
+			{"oakland", GeoLocation{Latitude: 37.8044, Longitude: -122.2712}},
+			{"new york", GeoLocation{Latitude: 40.7128, Longitude: -74.0060}},
+		}
+		groups := make([]Group, len(places))
+		for i, place := range places {
+			group, err := owner.CreateGroup(place.name)
+			if err != nil {
+				t.Fatal(err)
+			} else if group.CreatedAt == 0 {
+				t.Error("Group was created without a creation time")
+			}
+			location := place.location
+			if err = owner.UpdateGroupInfo(group.Uuid, GroupRequest{Location: &location}); err != nil {
+				t.Fatal(err)
+			}
+			groups[i] = group
+		}
+		if _, err := owner.CreateGroup("nowhere"); err != nil {
+			t.Fatal(err)
+		}
+		if err := member.GroupOp("", groups[0].Uuid, JoinGroup); err != nil {
+			t.Fatal(err)
+		}
+
+		description, emoji := "hills and fog", EmojiContent("🌁")
+		update := GroupRequest{Description: &description, Emoji: &emoji}
+		if err := member.UpdateGroupInfo(groups[0].Uuid, update); err == nil {
+			t.Error("Member who is not an admin updated a group")
+		}
+		if err := owner.UpdateGroupInfo(groups[0].Uuid, update); err != nil {
+			t.Fatal(err)
+		}
+		invalid := GeoLocation{Latitude: 91}
+		if err := owner.UpdateGroupInfo(groups[0].Uuid, GroupRequest{Location: &invalid}); err == nil {
+			t.Error("Set a latitude outside of -90 to 90")
+		}
+		got, err := s.GetGroup(ctx, groups[0].Uuid)
+		if err != nil {
+			t.Fatal(err)
+		} else if got.Description != description || got.Emoji != emoji ||
+			got.Location == nil || *got.Location != places[0].location {
+			t.Errorf("Unexpected group after updating its info %+v", got)
+		}
+
+		if d := places[0].location.DistanceKm(places[2].location); d < 4100 || d > 4150 {
+			t.Errorf("San Francisco is %v km from New York, want about 4130", d)
+		}
+		near, err := member.ListGroupsNear(places[1].location, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(near) != 2 || near[0].Uuid != groups[1].Uuid || near[1].Uuid != groups[0].Uuid {
+			t.Errorf("Got groups %+v near oakland, want oakland then san francisco", near)
+		}
+		if near, err = member.ListGroupsNear(places[1].location, 5); err != nil {
+			t.Fatal(err)
+		} else if len(near) != 1 || near[0].Uuid != groups[1].Uuid {
+			t.Errorf("Got groups %+v within 5km of oakland, want only oakland", near)
+		}
+
+		if err = owner.UpdateGroupInfo(groups[1].Uuid, GroupRequest{ClearLocation: true}); err != nil {
+			t.Fatal(err)
+		}
+		if near, err = member.ListGroupsNear(places[1].location, 5); err != nil {
+			t.Fatal(err)
+		} else if len(near) != 0 {
+			t.Errorf("Got %d groups near oakland after removing its location, want 0", len(near))
+		}
+	})
+}
+
+func TestGroupLimits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		s.MaxGroupSize = 3
+		clients := newTestClients(t, ts, 4)
+		owner := clients[0]
+		ctx := context.Background()
+
+		unlimited, err := owner.CreateGroup("as big as allowed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, c := range clients[1:] {
+			err := c.GroupOp("", unlimited.Uuid, JoinGroup)
+			if full := i+2 > s.MaxGroupSize; full && err == nil {
+				t.Error("Joined a group with more members than the server allows")
+			} else if !full && err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		limited, err := owner.CreateGroup("small")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tooMany := s.MaxGroupSize + 1
+		if err = owner.UpdateGroupInfo(limited.Uuid, GroupRequest{MemberLimit: &tooMany}); err == nil {
+			t.Error("Set a member limit above what the server allows")
+		}
+		limit, lock := 2, true
+		if err = owner.UpdateGroupInfo(limited.Uuid, GroupRequest{MemberLimit: &limit, LockWhenFull: &lock}); err != nil {
+			t.Fatal(err)
+		}
+		if err = clients[1].GroupOp("", limited.Uuid, JoinGroup); err != nil {
+			t.Fatal(err)
+		}
+		if err = clients[2].GroupOp("", limited.Uuid, JoinGroup); err == nil {
+			t.Error("Joined a full group")
+		}
+		got, err := s.GetGroup(ctx, limited.Uuid)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(got.Users) != limit || !got.Locked {
+			t.Errorf("Group has %d members and locked %v once full, want %d and locked", len(got.Users), got.Locked, limit)
+		}
+
+		// Invites cannot be used to get into a full group either.
+		invite, err := owner.CreateGroupInvite(limited.Uuid, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clients[2].JoinGroup(limited.Uuid, invite.Code); err == nil {
+			t.Error("Joined a full group with an invite")
+		}
+		if invites, err := owner.ListGroupInvites(limited.Uuid); err != nil {
+			t.Fatal(err)
+		} else if len(invites) != 1 {
+			t.Error("Invite was used up by failing to join a full group")
+		}
+	})
+}
+
+func TestGroupBans(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 4)
+		owner, troll, lurker, member := clients[0], clients[1], clients[2], clients[3]
+		ctx := context.Background()
+
+		group, err := owner.CreateGroup("moderated")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []*mojiClient{troll, member} {
+			if err = c.GroupOp("", group.Uuid, JoinGroup); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = member.GroupMemberOp(group.Uuid, troll.UserID(), BanFromGroupOp); err == nil {
+			t.Error("Member who is not an admin banned someone")
+		}
+		if err = owner.GroupMemberOp(group.Uuid, troll.UserID(), BanFromGroupOp); err != nil {
+			t.Fatal(err)
+		}
+		// People who never joined can be banned too.
+		if err = owner.GroupMemberOp(group.Uuid, lurker.UserID(), BanFromGroupOp); err != nil {
+			t.Fatal(err)
+		}
+		if err = owner.GroupMemberOp(group.Uuid, lurker.UserID(), KickFromGroup); err == nil {
+			t.Error("Kicked someone who is not a member")
+		}
+
+		got, err := s.GetGroup(ctx, group.Uuid)
+		if err != nil {
+			t.Fatal(err)
+		} else if got.IsMember(troll.UserID()) {
+			t.Error("Banned member is still in the group")
+		}
+		banned, err := owner.ListBannedFromGroup(group.Uuid)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(banned) != 2 {
+			t.Errorf("Got %d banned users, want 2", len(banned))
+		}
+
+		if err = troll.GroupOp("", group.Uuid, JoinGroup); err == nil {
+			t.Error("Banned user joined the group")
+		}
+		if err = owner.GroupOp("", group.Uuid, SwitchLockGroup); err != nil {
+			t.Fatal(err)
+		}
+		invite, err := owner.CreateGroupInvite(group.Uuid, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = troll.JoinGroup(group.Uuid, invite.Code); err == nil {
+			t.Error("Banned user joined the group with an invite")
+		}
+		if err = troll.GroupOp("", group.Uuid, RequestToJoinGroup); err == nil {
+			t.Error("Banned user asked to join the group")
+		}
+
+		if err = owner.GroupMemberOp(group.Uuid, troll.UserID(), UnbanFromGroupOp); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = troll.JoinGroup(group.Uuid, invite.Code); err != nil {
+			t.Errorf("Could not join after being unbanned: %v", err)
+		}
+	})
+}
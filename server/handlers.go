@@ -7,7 +7,8 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
-	"strconv"
+	"sort"
+	"strings"
 	"time"
 
 	expo "github.com/oliveroneill/exponent-server-sdk-golang/sdk"
@@ -40,21 +41,15 @@ func (s *Server) SignUpHandler() func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "Failed when signing up: %v", err)
 			return
 		}
-		loginToken, err := s.Login(context.Background(), email, sup.HashedPassword)
+		resp, err := s.Login(context.Background(), email, sup.HashedPassword, sup.Device)
 		if err != nil {
 			w.WriteHeader(401)
 			fmt.Fprintf(w, "Failed when logging up: %v", err)
 			return
 		}
-		user, exists := s.UserFor(context.Background(), loginToken)
-		if !exists {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "User does not exist after signing up: %v", err)
-			return
-		}
-		resp := LoginResponse{
-			User:       *user,
-			LoginToken: loginToken,
+		// The user can ask for another code, so failing to send one does not fail signing up.
+		if err = s.SendVerificationEmail(context.Background(), &resp.User); err != nil {
+			fmt.Printf("Failed to send verification email: %v\n", err)
 		}
 		enc.Encode(resp)
 		return
@@ -82,21 +77,149 @@ func (s *Server) LoginHandler() func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "Error logging in, email does not appear to be an email: %v", err)
 			return
 		}
-		loginToken, err := s.Login(context.Background(), email, lp.HashedPassword)
+		resp, err := s.Login(context.Background(), email, lp.HashedPassword, lp.Device)
 		if err != nil {
 			w.WriteHeader(401)
 			fmt.Fprint(w, "Error logging in, email or password may be incorrect")
 			return
 		}
-		user, exists := s.UserFor(context.Background(), loginToken)
-		if !exists {
+		enc := json.NewEncoder(w)
+		enc.Encode(resp)
+		return
+	}
+}
+
+func (s *Server) VerifyEmailHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		var req VerifyEmailRequest
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Malformed request: %v", err)
+			return
+		}
+		ctx := r.Context()
+		user := UserFromContext(ctx)
+		switch req.Kind {
+		case ResendVerification:
+			if user.Verified {
+				w.WriteHeader(400)
+				fmt.Fprint(w, "Email is already verified")
+				return
+			}
+			if err := s.SendVerificationEmail(ctx, user); err == errEmailCodeCooldown {
+				w.WriteHeader(429)
+				fmt.Fprint(w, err)
+				return
+			} else if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to send verification email: %v", err)
+				return
+			}
+		case ConfirmVerification:
+			if user.Verified {
+				break
+			}
+			if _, err := s.ConfirmEmail(ctx, user.Uuid, req.Code); err != nil {
+				w.WriteHeader(401)
+				fmt.Fprintf(w, "Failed to verify email: %v", err)
+				return
+			}
+		default:
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "Unknown verify email op %v", req.Kind)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+}
+
+func (s *Server) ResetPasswordHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		var req ResetPasswordRequest
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Malformed request: %v", err)
+			return
+		}
+		email, err := NewEmail(req.Email)
+		if err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Failed when parsing email: %v", err)
+			return
+		}
+		if err = s.RequestPasswordReset(r.Context(), email); err != nil {
 			w.WriteHeader(500)
-			fmt.Fprint(w, "User does not exist")
+			fmt.Fprintf(w, "Failed to send reset code: %v", err)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+}
+
+func (s *Server) ConfirmResetPasswordHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		var req ConfirmResetPasswordRequest
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Malformed request: %v", err)
+			return
+		}
+		email, err := NewEmail(req.Email)
+		if err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Failed when parsing email: %v", err)
+			return
+		}
+		err = s.ConfirmPasswordReset(r.Context(), email, req.Code, req.NewHashedPassword)
+		if err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Failed to reset password: %v", err)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+}
+
+func (s *Server) RefreshHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		var req RefreshRequest
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Malformed request: %v", err)
 			return
 		}
-		resp := LoginResponse{
-			User:       *user,
-			LoginToken: loginToken,
+		resp, err := s.Refresh(context.Background(), req.RefreshToken)
+		if err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Error refreshing session: %v", err)
+			return
 		}
 		enc := json.NewEncoder(w)
 		enc.Encode(resp)
@@ -104,6 +227,164 @@ func (s *Server) LoginHandler() func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) LogoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		var req LogoutRequest
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Malformed request: %v", err)
+			return
+		}
+		ctx := r.Context()
+		user := UserFromContext(ctx)
+		if err := s.Logout(ctx, user, SessionFromContext(ctx), req.Everywhere); err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to log out: %v", err)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+}
+
+func (s *Server) ProfileHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		var req UpdateProfileRequest
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Malformed request: %v", err)
+			return
+		}
+		user := UserFromContext(r.Context())
+		updated, err := s.UpdateProfile(r.Context(), user.Uuid, &req)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Failed to update profile: %v", err)
+			return
+		}
+		enc := json.NewEncoder(w)
+		enc.Encode(updated)
+		return
+	}
+}
+
+func (s *Server) DeleteAccountHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		var req DeleteAccountRequest
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Malformed request: %v", err)
+			return
+		}
+		ctx := r.Context()
+		user := UserFromContext(ctx)
+		// Make sure it is the user themself, and not someone who found a logged in device.
+		existing, err := s.PasswordHash(ctx, user.Uuid)
+		if err != nil || !checkPassword(existing, req.HashedPassword) {
+			w.WriteHeader(401)
+			fmt.Fprint(w, "Password is incorrect")
+			return
+		}
+		if err = s.DeleteAccount(ctx, user); err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to delete account: %v", err)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+}
+
+func (s *Server) SessionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		var req SessionRequest
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Malformed request: %v", err)
+			return
+		}
+		user := UserFromContext(r.Context())
+		current := SessionFromContext(r.Context())
+		ctx := context.Background()
+
+		switch req.Kind {
+		case ListSessions:
+			sessions, err := s.SessionsForUser(ctx, user.Uuid)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to get sessions: %v", err)
+				return
+			}
+			var resp ListSessionsResponse
+			for _, session := range sessions {
+				resp.Sessions = append(resp.Sessions, SessionInfo{
+					Uuid:      session.Uuid,
+					Device:    session.Device,
+					CreatedAt: session.CreatedAt,
+					LastSeen:  session.LastSeen,
+					Current:   current != nil && current.Uuid == session.Uuid,
+				})
+			}
+			enc := json.NewEncoder(w)
+			enc.Encode(resp)
+			return
+		case RevokeSession:
+			session, err := s.GetSession(ctx, req.Session)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to get session: %v", err)
+				return
+			} else if session == nil || session.User != user.Uuid {
+				w.WriteHeader(404)
+				fmt.Fprint(w, "No such session")
+				return
+			}
+			if err = s.revokeSession(ctx, user.Uuid, session.Uuid); err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to revoke session: %v", err)
+				return
+			}
+		case RevokeAllSessions:
+			if err := s.revokeAllSessions(ctx, user.Uuid); err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to revoke sessions: %v", err)
+				return
+			}
+		default:
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "Unknown session op %v", req.Kind)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+}
+
 func (s *Server) ListPeopleHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -123,19 +404,25 @@ func (s *Server) ListPeopleHandler() http.HandlerFunc {
 		if req.Amount > 50 {
 			req.Amount = 50
 		}
-		if err := s.ValidateLoginToken(req.LoginToken); err != nil {
-			w.WriteHeader(401)
-			fmt.Fprintf(w, "Invalid login token: %v", err)
+		user := UserFromContext(r.Context())
+		amt := req.Amount
+		var resp ListPeopleResponse
+		friends, err := s.ListFriends(context.Background(), user.Uuid)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to get friends: %v", err)
 			return
 		}
-		user, exists := s.UserFor(context.Background(), req.LoginToken)
-		if !exists {
-			w.WriteHeader(401)
-			fmt.Fprint(w, "User does not exist")
+		friendSet := make(map[Uuid]struct{}, len(friends))
+		for _, uuid := range friends {
+			friendSet[uuid] = struct{}{}
+		}
+		blocked, err := s.blockSet(context.Background(), user.Uuid)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to get blocked users: %v", err)
 			return
 		}
-		amt := req.Amount
-		var resp ListPeopleResponse
 		var cond func(*User) bool
 		switch req.Kind {
 		case All:
@@ -144,7 +431,7 @@ func (s *Server) ListPeopleHandler() http.HandlerFunc {
 			// Omitted due to separate loop below
 		case NotFriends:
 			cond = func(u *User) bool {
-				_, exists := s.Friends[user.Uuid][u.Uuid]
+				_, exists := friendSet[u.Uuid]
 				return !exists
 			}
 		default:
@@ -156,7 +443,7 @@ func (s *Server) ListPeopleHandler() http.HandlerFunc {
 		cond_w_match := func(u *User) bool { return cond(u) && matchFn(u.Name) }
 
 		if req.Kind == OnlyFriends {
-			for uuid := range s.Friends[user.Uuid] {
+			for _, uuid := range friends {
 				if uuid == user.Uuid {
 					continue
 				}
@@ -167,7 +454,7 @@ func (s *Server) ListPeopleHandler() http.HandlerFunc {
 				} else if person == nil {
 					continue
 				}
-				resp.People = append(resp.People, *person)
+				resp.People = append(resp.People, person.Public())
 				amt -= 1
 				if amt == 0 {
 					break
@@ -184,10 +471,19 @@ func (s *Server) ListPeopleHandler() http.HandlerFunc {
 				if person.Uuid == user.Uuid {
 					continue
 				}
+				if s.Unverified.ListPeople && !person.Verified {
+					continue
+				}
+				if _, isFriend := friendSet[person.Uuid]; person.Undiscoverable && !isFriend {
+					continue
+				}
+				if _, isBlocked := blocked[person.Uuid]; isBlocked {
+					continue
+				}
 				if !cond_w_match(&person) {
 					continue
 				}
-				resp.People = append(resp.People, person)
+				resp.People = append(resp.People, person.Public())
 				amt -= 1
 				if amt == 0 {
 					break
@@ -220,18 +516,7 @@ func (s *Server) AckMsgHandler() http.HandlerFunc {
 			fmt.Fprint(w, "Cannot send empty reply")
 			return
 		}
-		token := req.LoginToken
-		if err := s.ValidateLoginToken(token); err != nil {
-			w.WriteHeader(401)
-			fmt.Fprintf(w, "Error validating login token %v", err)
-			return
-		}
-		user, exists := s.UserFor(context.Background(), token)
-		if !exists {
-			w.WriteHeader(401)
-			fmt.Fprint(w, "User does not exist")
-			return
-		}
+		user := UserFromContext(r.Context())
 		// originalMessage, exists := s.Messages[req.MsgID]
 		originalMessage, err := s.GetMessage(context.Background(), req.MsgID)
 		if err != nil {
@@ -248,7 +533,11 @@ func (s *Server) AckMsgHandler() http.HandlerFunc {
 
 		// Do not delete the original message here since other users may need to see it, but now a
 		// specific user should not be able to see it anymore.
-		delete(s.UserToMessages[user.Uuid], req.MsgID)
+		if err = s.RemoveFromInbox(context.Background(), user.Uuid, req.MsgID); err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error removing message from inbox: %v", err)
+			return
+		}
 
 		replyUuid, err := generateUuid()
 		if err != nil {
@@ -257,21 +546,42 @@ func (s *Server) AckMsgHandler() http.HandlerFunc {
 			return
 		}
 		// TODO check for collisions?
-		s.Replies[replyUuid] = &MessageReply{
+		reply := &MessageReply{
+			Uuid:            replyUuid,
 			Message:         originalMessage,
 			OriginalContent: originalMessage.Emojis,
 			Reply:           req.Reply,
-			From:            *user,
+			From:            user.Public(),
 			Group:           originalMessage.Group,
+			SentAt:          time.Now().Unix(),
+		}
+		ctx := context.Background()
+		if err = s.AddReply(ctx, reply); err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to save reply: %v", err)
+			return
 		}
 		source := originalMessage.Source
-		s.UserToReplies[source.Uuid] = append(s.UserToReplies[source.Uuid], replyUuid)
-		s.UserToReplies[user.Uuid] = append(s.UserToReplies[user.Uuid], replyUuid)
+		recipients := []Uuid{user.Uuid}
+		if blocked, err := s.blockedBetween(ctx, user.Uuid, source.Uuid); err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to check blocked users: %v", err)
+			return
+		} else if !blocked {
+			recipients = append(recipients, source.Uuid)
+		}
+		for _, recipient := range recipients {
+			if err = s.AddReplyForUser(ctx, recipient, reply); err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to deliver reply: %v", err)
+				return
+			}
+		}
 		// TODO need to add the ability to add group notifications here
 		go s.sendAckPushNotification(
-			source.Uuid, originalMessage.Group, user.Name, originalMessage.Emojis, req.Reply,
+			source.Uuid, originalMessage.Group, user, originalMessage.Emojis, req.Reply,
 		)
-		go s.LogReply(s.Replies[replyUuid])
+		go s.LogReply(reply)
 
 		w.WriteHeader(200)
 		return
@@ -281,51 +591,24 @@ func (s *Server) AckMsgHandler() http.HandlerFunc {
 func (s *Server) sendAckPushNotification(
 	senderUuid Uuid,
 	groupUuid Uuid,
-	responderName string,
+	responder *User,
 	original EmojiContent,
 	reply EmojiReply,
 ) {
 	ctx := context.Background()
-	notifToken, err := s.RedisClient.HGet(ctx, "user_notif_tokens", senderUuid.String()).Result()
-	if err != nil {
-		fmt.Printf("Failed to get user notif token: %v", err)
-		return
-	} else if notifToken == "" {
+	to := s.notifTokensFor(ctx, responder.Uuid, []Uuid{senderUuid})
+	if len(to) == 0 {
 		return
 	}
-	to := []expo.ExponentPushToken{expo.ExponentPushToken(notifToken)}
 	if groupUuid.IsValid() {
-		users, err := s.UsersInGroupRaw(ctx, groupUuid)
+		users, err := s.UsersInGroup(ctx, groupUuid)
 		if err == nil {
-			notifTokens, err := s.RedisClient.HMGet(ctx, "user_notif_tokens", users...).Result()
-			if err == nil {
-				for _, notifToken := range notifTokens {
-					nt, ok := notifToken.(string)
-					if !ok {
-						continue
-					}
-					to = append(to, expo.ExponentPushToken(nt))
-				}
-			}
+			to = append(to, s.notifTokensFor(ctx, responder.Uuid, users)...)
 		}
 	}
 
-	pushBody := fmt.Sprintf("%s: %s ↩️ %s", responderName, reply, original)
-	pushMsg := expo.PushMessage{
-		To:       to,
-		Body:     pushBody,
-		Sound:    "default",
-		Title:    "📨↩️",
-		Priority: expo.DefaultPriority,
-	}
-	client := expo.NewPushClient(nil)
-	resp, err := client.Publish(&pushMsg)
-	if err != nil {
-		fmt.Println(err)
-	}
-	if resp.ValidateResponse() != nil {
-		fmt.Println("Failed to send push notification")
-	}
+	pushBody := fmt.Sprintf("%s: %s ↩️ %s", responder.Name, reply, original)
+	sendPush(to, "📨↩️", pushBody)
 }
 
 func (s *Server) GroupHandler() http.HandlerFunc {
@@ -343,70 +626,34 @@ func (s *Server) GroupHandler() http.HandlerFunc {
 			fmt.Fprintf(w, "Error decoding request: %v", err)
 			return
 		}
-		token := req.LoginToken
-		if err := s.ValidateLoginToken(token); err != nil {
-			w.WriteHeader(401)
-			fmt.Fprintf(w, "Error validating request: %v", err)
-			return
-		}
-		user, exists := s.UserFor(context.Background(), token)
-		if !exists {
-			w.WriteHeader(401)
-			fmt.Fprint(w, "User does not exist")
-			return
-		}
+		user := UserFromContext(r.Context())
+		ctx := context.Background()
 
+		var err error
 		switch req.Kind {
 		case JoinGroup:
-			group, err := s.GetGroup(context.Background(), req.GroupUuid)
-			if err != nil {
-				w.WriteHeader(500)
-				fmt.Fprintf(w, "Failed to find group: %v", err)
-				return
-			} else if group == nil {
-				w.WriteHeader(404)
-				fmt.Fprint(w, "No Such group")
+			var group *Group
+			if group, err = s.joinGroup(ctx, user, req.GroupUuid, req.InviteCode); err == nil {
+				go s.joinGroupNotification(group, user)
+				// The group is sent back since it may have only been known from the invite.
+				enc := json.NewEncoder(w)
+				enc.Encode(group)
 				return
 			}
-			group.Users[user.Uuid] = user.Name
-			ctx := context.Background()
-			if err = s.AddGroup(ctx, group); err != nil {
-				w.WriteHeader(500)
-				fmt.Fprintf(w, "Failed to save change to group: %v", err)
-				return
-			}
-			if err = s.AddUserToGroup(ctx, user.Uuid, req.GroupUuid); err != nil {
-				w.WriteHeader(500)
-				fmt.Fprintf(w, "Failed to add user to group: %v", err)
-				return
-			}
-			go s.joinGroupNotification(group, user.Name)
 		case LeaveGroup:
-			group, err := s.GetGroup(context.Background(), req.GroupUuid)
-			if err != nil {
-				w.WriteHeader(500)
-				fmt.Fprintf(w, "Failed to find group: %v", err)
-				return
-			} else if group == nil {
-				w.WriteHeader(404)
-				fmt.Fprint(w, "No Such group")
-				return
-			}
-			delete(group.Users, user.Uuid)
-			s.DeleteUserFromGroup(context.Background(), user.Uuid, req.GroupUuid)
-			if len(group.Users) == 0 {
-				s.DeleteGroup(context.Background(), req.GroupUuid)
-			} else {
-				if err = s.AddGroup(context.Background(), group); err != nil {
-					w.WriteHeader(500)
-					fmt.Fprintf(w, "Failed to update group: %v", err)
-					return
-				}
+			var group *Group
+			if group, err = s.leaveGroup(ctx, user.Uuid, req.GroupUuid); err == nil && group == nil {
+				err = errNoGroup
 			}
 		case CreateGroup:
-			if len(req.GroupName) < 3 {
-				w.WriteHeader(401)
-				fmt.Fprint(w, "Must specify at least 3 characters for group name")
+			if !validGroupName(req.GroupName) {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Group name must be between 3 and %d characters", maxNameLength)
+				return
+			}
+			if err := s.validateGroupInfo(&req); err != nil {
+				w.WriteHeader(400)
+				fmt.Fprint(w, err)
 				return
 			}
 			uuid, err := generateUuid()
@@ -421,9 +668,11 @@ func (s *Server) GroupHandler() http.HandlerFunc {
 				Users: map[Uuid]string{
 					user.Uuid: user.Name,
 				},
+				Owner:     user.Uuid,
+				CreatedAt: time.Now().Unix(),
 			}
-			ctx := context.Background()
-			if err = s.AddGroup(context.Background(), &group); err != nil {
+			s.applyGroupInfo(&group, &req)
+			if err = s.AddGroup(ctx, &group); err != nil {
 				w.WriteHeader(500)
 				fmt.Fprintf(w, "Failed to update group: %v", err)
 				return
@@ -433,23 +682,148 @@ func (s *Server) GroupHandler() http.HandlerFunc {
 				fmt.Fprintf(w, "Failed to add user to group: %v", err)
 				return
 			}
+			enc := json.NewEncoder(w)
+			enc.Encode(group)
+			return
 		case SwitchLockGroup:
-			group, err := s.GetGroup(context.Background(), req.GroupUuid)
-			if err != nil {
-				w.WriteHeader(500)
-				fmt.Fprintf(w, "Failed to find group: %v", err)
+			_, err = s.updateGroup(ctx, req.GroupUuid, func(group *Group) error {
+				if !group.IsAdmin(user.Uuid) {
+					return errNotGroupAdmin
+				}
+				group.Locked = !group.Locked
+				return nil
+			})
+		case RenameGroup:
+			if !validGroupName(req.GroupName) {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Group name must be between 3 and %d characters", maxNameLength)
 				return
-			} else if group == nil {
-				w.WriteHeader(404)
-				fmt.Fprint(w, "No Such group")
+			}
+			_, err = s.updateGroup(ctx, req.GroupUuid, func(group *Group) error {
+				if !group.IsAdmin(user.Uuid) {
+					return errNotGroupAdmin
+				}
+				group.Name = req.GroupName
+				return nil
+			})
+		case UpdateGroupInfo:
+			if err = s.validateGroupInfo(&req); err != nil {
+				w.WriteHeader(400)
+				fmt.Fprint(w, err)
 				return
 			}
-			group.Locked = !group.Locked
-			if err = s.AddGroup(context.Background(), group); err != nil {
-				w.WriteHeader(500)
-				fmt.Fprintf(w, "Failed to update group: %v", err)
+			_, err = s.updateGroup(ctx, req.GroupUuid, func(group *Group) error {
+				if !group.IsAdmin(user.Uuid) {
+					return errNotGroupAdmin
+				}
+				s.applyGroupInfo(group, &req)
+				return nil
+			})
+		case KickFromGroup, BanFromGroupOp:
+			ban := req.Kind == BanFromGroupOp
+			var group *Group
+			var removed bool
+			if group, removed, err = s.kickFromGroup(ctx, user.Uuid, req.Other, req.GroupUuid, ban); removed {
+				go s.sendRemovedFromGroupPushNotification(group, req.Other, ban)
+			}
+		case UnbanFromGroupOp:
+			err = s.unbanFromGroup(ctx, user.Uuid, req.Other, req.GroupUuid)
+		case ListBannedFromGroup:
+			var banned []PublicUser
+			if banned, err = s.bannedFromGroup(ctx, user.Uuid, req.GroupUuid); err == nil {
+				enc := json.NewEncoder(w)
+				enc.Encode(ListBannedFromGroupResponse{Banned: banned})
+				return
+			}
+		case PromoteInGroup, DemoteInGroup:
+			_, err = s.updateGroup(ctx, req.GroupUuid, func(group *Group) error {
+				if !group.IsAdmin(user.Uuid) {
+					return errNotGroupAdmin
+				} else if !group.IsMember(req.Other) {
+					return errNotGroupMember
+				} else if req.Other == group.Owner {
+					return nil
+				}
+				if req.Kind == DemoteInGroup {
+					if user.Uuid != group.Owner {
+						return errNotGroupOwner
+					}
+					delete(group.Admins, req.Other)
+					return nil
+				}
+				if group.Admins == nil {
+					group.Admins = map[Uuid]bool{}
+				}
+				group.Admins[req.Other] = true
+				return nil
+			})
+		case CreateGroupInvite:
+			if req.InviteMaxUses < 0 || req.InviteTTL < 0 ||
+				time.Duration(req.InviteTTL)*time.Second > maxInviteDuration {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Invites can last for at most %v", maxInviteDuration)
 				return
 			}
+			duration := time.Duration(req.InviteTTL) * time.Second
+			var invite *GroupInvite
+			invite, err = s.createGroupInvite(ctx, user.Uuid, req.GroupUuid, req.InviteMaxUses, duration)
+			if err == nil {
+				enc := json.NewEncoder(w)
+				enc.Encode(invite)
+				return
+			}
+		case ListGroupInvites:
+			var invites []GroupInvite
+			if invites, err = s.groupInvites(ctx, user.Uuid, req.GroupUuid); err == nil {
+				enc := json.NewEncoder(w)
+				enc.Encode(ListGroupInvitesResponse{Invites: invites})
+				return
+			}
+		case RevokeGroupInvite:
+			err = s.revokeGroupInvite(ctx, user.Uuid, req.GroupUuid, req.InviteCode)
+		case RequestToJoinGroup:
+			var group *Group
+			var requested bool
+			if group, requested, err = s.requestToJoinGroup(ctx, user, req.GroupUuid); requested {
+				go s.sendJoinRequestPushNotification(group, user)
+			}
+		case ListJoinRequests:
+			var requests []PublicUser
+			if requests, err = s.joinRequests(ctx, user.Uuid, req.GroupUuid); err == nil {
+				enc := json.NewEncoder(w)
+				enc.Encode(ListJoinRequestsResponse{Requests: requests})
+				return
+			}
+		case ApproveJoinRequest, RejectJoinRequest:
+			approve := req.Kind == ApproveJoinRequest
+			var group *Group
+			if group, err = s.answerJoinRequest(ctx, user.Uuid, req.GroupUuid, req.Other, approve); err == nil {
+				go s.sendJoinRequestAnsweredPushNotification(group, req.Other, approve)
+			}
+		default:
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "Unknown group op %v", req.Kind)
+			return
+		}
+		switch err {
+		case nil:
+		case errNoGroup, errNoJoinRequest:
+			w.WriteHeader(404)
+			fmt.Fprint(w, err)
+			return
+		case errNotGroupMember, errNotGroupAdmin, errNotGroupOwner, errGroupLocked, errGroupFull,
+			errBannedFromGroup, errInvalidInvite:
+			w.WriteHeader(403)
+			fmt.Fprint(w, err)
+			return
+		case errGroupNotLocked:
+			w.WriteHeader(400)
+			fmt.Fprint(w, err)
+			return
+		default:
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to update group: %v", err)
+			return
 		}
 
 		w.WriteHeader(200)
@@ -457,45 +831,21 @@ func (s *Server) GroupHandler() http.HandlerFunc {
 	}
 }
 
-func (s *Server) joinGroupNotification(group *Group, newUserName string) {
+func (s *Server) joinGroupNotification(group *Group, newUser *User) {
 	usersInGroup := make([]Uuid, 0, len(group.Users))
-	for uuid, name := range group.Users {
-		if name != newUserName {
+	for uuid := range group.Users {
+		if uuid != newUser.Uuid {
 			usersInGroup = append(usersInGroup, uuid)
 		}
 	}
-	ctx := context.Background()
-	var to []expo.ExponentPushToken
-	for _, uuid := range usersInGroup {
-		notifToken, err := s.RedisClient.HGet(ctx, "user_notif_tokens", uuid.String()).Result()
-		if err != nil {
-			fmt.Printf("Failed to get user notif token: %v", err)
-			continue
-		} else if notifToken == "" {
-			continue
-		}
-		to = append(to, expo.ExponentPushToken(notifToken))
-	}
+	newUserName := newUser.Name
+	to := s.notifTokensFor(context.Background(), newUser.Uuid, usersInGroup)
 	if len(to) == 0 {
 		return
 	}
 
 	pushBody := fmt.Sprintf("👋 %s➕%s 🎉", group.Name, newUserName)
-	pushMsg := expo.PushMessage{
-		To:       to,
-		Body:     pushBody,
-		Sound:    "default",
-		Title:    "👥➕",
-		Priority: expo.DefaultPriority,
-	}
-	client := expo.NewPushClient(nil)
-	resp, err := client.Publish(&pushMsg)
-	if err != nil {
-		fmt.Println(err)
-	}
-	if resp.ValidateResponse() != nil {
-		fmt.Println("Failed to send push notification")
-	}
+	sendPush(to, "👥➕", pushBody)
 }
 
 func (s *Server) ListGroupHandler() http.HandlerFunc {
@@ -513,18 +863,7 @@ func (s *Server) ListGroupHandler() http.HandlerFunc {
 			fmt.Fprintf(w, "Invalid request: %v\n", err)
 			return
 		}
-		// TODO why is validating tokens not working?
-		if err := s.ValidateLoginToken(req.LoginToken); err != nil {
-			w.WriteHeader(401)
-			fmt.Fprintf(w, "Error validating login token: %v", err)
-			return
-		}
-		user, exists := s.UserFor(context.Background(), req.LoginToken)
-		if !exists {
-			w.WriteHeader(401)
-			fmt.Fprint(w, "User does not exist")
-			return
-		}
+		user := UserFromContext(r.Context())
 		amt := req.Amount
 		var resp ListGroupResponse
 		var cond func(context.Context, Group) (bool, error)
@@ -550,161 +889,409 @@ func (s *Server) ListGroupHandler() http.HandlerFunc {
 			fmt.Fprint(w, "Invalid op kind")
 			return
 		}
+		withinKm := req.WithinKm
+		if req.Near != nil {
+			if !req.Near.IsValid() || withinKm < 0 {
+				w.WriteHeader(400)
+				fmt.Fprint(w, "Invalid location to list groups near")
+				return
+			} else if withinKm == 0 {
+				withinKm = defaultNearbyKm
+			}
+		}
 		matchFn := req.Filter.MatchFunc()
 		cond_w_match := func(ctx context.Context, g Group) (bool, error) {
 			if !matchFn(g.Name) {
 				return false, nil
 			}
+			if req.Near != nil && (g.Location == nil || req.Near.DistanceKm(*g.Location) > withinKm) {
+				return false, nil
+			}
 			return cond(ctx, g)
 		}
-
-		groups, err := s.GetGroups(context.Background())
+
+		groups, err := s.GetGroups(context.Background())
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to get groups: %v", err)
+			return
+		}
+		// TODO this is inefficient since we explicitly iterate over everyone.
+		// Probably need to fix later when actually using a database.
+		ctx := context.Background()
+		for _, group := range groups {
+			matches, err := cond_w_match(ctx, group)
+			if !matches || err != nil {
+				continue
+			}
+			resp.Groups = append(resp.Groups, group)
+			if req.Near != nil {
+				// All nearby groups are needed to find the nearest ones.
+				continue
+			}
+			amt -= 1
+			if amt == 0 {
+				break
+			}
+		}
+		if req.Near != nil {
+			sort.SliceStable(resp.Groups, func(i, j int) bool {
+				return req.Near.DistanceKm(*resp.Groups[i].Location) <
+					req.Near.DistanceKm(*resp.Groups[j].Location)
+			})
+			if amt > 0 && len(resp.Groups) > amt {
+				resp.Groups = resp.Groups[:amt]
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.Encode(resp)
+		return
+	}
+}
+
+func (s *Server) RecommendationHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		var req RecommendationRequest
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Error parsing request: %v", err)
+			return
+		}
+		recs := make(map[EmojiContent]struct{})
+		switch int(math.Round(req.LocalTime)) % 24 {
+		case 6, 7, 8, 9:
+			recs = map[EmojiContent]struct{}{
+				"🥞🍳🥓":  struct{}{},
+				"🫖'🥐🌅": struct{}{},
+				"🏃🌄🚲":  struct{}{},
+				"💪🤸💪":  struct{}{},
+				"☕️🍩🥣": struct{}{},
+			}
+		case 10, 11:
+			recs = map[EmojiContent]struct{}{
+				"💻📝🎧": struct{}{},
+			}
+		case 12, 13:
+			recs = map[EmojiContent]struct{}{
+				"🍕🍔🌯": struct{}{},
+				"🥗🥙🍲": struct{}{},
+				"🍱🍚🍛": struct{}{},
+			}
+		case 14, 15:
+			recs = map[EmojiContent]struct{}{
+				"💻📝🎧": struct{}{},
+			}
+		case 16, 17:
+			recs = map[EmojiContent]struct{}{
+				"🏀🎾🏐": struct{}{},
+				"🎥🕴🎦": struct{}{},
+				"💻📝🎧": struct{}{},
+			}
+		case 18, 19:
+			recs = map[EmojiContent]struct{}{
+				"🍕🍔🌯": struct{}{},
+				"🥗🥙🍲": struct{}{},
+				"🍱🍚🍛": struct{}{},
+			}
+		case 21, 22:
+			recs = map[EmojiContent]struct{}{
+				"🍷🎉🍹": struct{}{},
+				"🍰🍦🍡": struct{}{},
+			}
+		case 23, 0, 1:
+			recs = map[EmojiContent]struct{}{
+				"🌌🚶🌃": struct{}{},
+			}
+		}
+		if recs == nil {
+			recs = make(map[EmojiContent]struct{})
+		}
+		for _, v := range s.FindNearRecommendations(10, req.LocalTime) {
+			recs[v] = struct{}{}
+		}
+		var resp RecommendationResponse
+		for rec := range recs {
+			resp.Recommendations = append(resp.Recommendations, rec)
+		}
+		for i := range resp.Recommendations {
+			j := rand.Intn(i + 1)
+			resp.Recommendations[i], resp.Recommendations[j] = resp.Recommendations[j], resp.Recommendations[i]
+		}
+		resp.Recommendations = resp.Recommendations[:5]
+
+		enc := json.NewEncoder(w)
+		enc.Encode(resp)
+		return
+	}
+}
+
+func (s *Server) FriendHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		var fp FriendRequest
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&fp); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Error decoding request: %v", err)
+			return
+		}
+		user := UserFromContext(r.Context())
+		ctx := context.Background()
+
+		if fp.Action == ListFriendRequests {
+			var resp ListFriendRequestsResponse
+			incoming, err := s.IncomingFriendRequests(ctx, user.Uuid)
+			if err == nil {
+				resp.Incoming, err = s.usersFor(ctx, incoming)
+			}
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to get friend requests: %v", err)
+				return
+			}
+			outgoing, err := s.OutgoingFriendRequests(ctx, user.Uuid)
+			if err == nil {
+				resp.Outgoing, err = s.usersFor(ctx, outgoing)
+			}
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to get friend requests: %v", err)
+				return
+			}
+			enc := json.NewEncoder(w)
+			enc.Encode(resp)
+			return
+		}
+
+		if fp.Other == user.Uuid {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Cannot be friends with yourself")
+			return
+		}
+		other, err := s.GetUser(ctx, fp.Other)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error getting user: %v", err)
+			return
+		} else if other == nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, "User does not exist")
+			return
+		}
+
+		switch fp.Action {
+		case Rmfriend:
+			err = s.removeFriend(ctx, user.Uuid, fp.Other)
+		case AddFriend:
+			_, err = s.sendFriendRequest(ctx, user, fp.Other)
+		case AcceptFriend:
+			err = s.acceptFriendRequest(ctx, user.Uuid, fp.Other)
+		case DeclineFriend:
+			err = s.deleteFriendRequest(ctx, fp.Other, user.Uuid)
+		case CancelFriend:
+			err = s.deleteFriendRequest(ctx, user.Uuid, fp.Other)
+		default:
+			w.WriteHeader(404)
+			fmt.Fprint(w, "Unknown friend action")
+			return
+		}
+		if err == errNoFriendRequest {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err)
+			return
+		} else if err == errBlocked {
+			w.WriteHeader(403)
+			fmt.Fprint(w, err)
+			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to update friends: %v", err)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+}
+
+func (s *Server) BlockHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "Not a POST request")
+			return
+		}
+		var req BlockRequest
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(401)
+			fmt.Fprintf(w, "Error decoding request: %v", err)
+			return
+		}
+		user := UserFromContext(r.Context())
+		ctx := context.Background()
+
+		var err error
+		switch req.Kind {
+		case BlockUser:
+			if req.Other == user.Uuid {
+				w.WriteHeader(400)
+				fmt.Fprint(w, "Cannot block yourself")
+				return
+			}
+			if other, err := s.GetUser(ctx, req.Other); err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Error getting user: %v", err)
+				return
+			} else if other == nil {
+				w.WriteHeader(404)
+				fmt.Fprint(w, "User does not exist")
+				return
+			}
+			err = s.block(ctx, user.Uuid, req.Other)
+		case UnblockUser:
+			err = s.unblock(ctx, user.Uuid, req.Other)
+		case ListBlockedOp:
+			var resp ListBlockedResponse
+			blocked, err := s.ListBlocked(ctx, user.Uuid)
+			if err == nil {
+				resp.Blocked, err = s.usersFor(ctx, blocked)
+			}
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to get blocked users: %v", err)
+				return
+			}
+			enc := json.NewEncoder(w)
+			enc.Encode(resp)
+			return
+		default:
+			w.WriteHeader(404)
+			fmt.Fprint(w, "Unknown block op")
+			return
+		}
 		if err != nil {
 			w.WriteHeader(500)
-			fmt.Fprintf(w, "Failed to get groups: %v", err)
+			fmt.Fprintf(w, "Failed to update blocked users: %v", err)
 			return
 		}
-		// TODO this is inefficient since we explicitly iterate over everyone.
-		// Probably need to fix later when actually using a database.
-		ctx := context.Background()
-		for _, group := range groups {
-			matches, err := cond_w_match(ctx, group)
-			if !matches || err != nil {
-				continue
-			}
-			resp.Groups = append(resp.Groups, group)
-			amt -= 1
-			if amt == 0 {
-				break
-			}
-		}
-		enc := json.NewEncoder(w)
-		enc.Encode(resp)
+		w.WriteHeader(200)
 		return
 	}
 }
 
-func (s *Server) RecommendationHandler() http.HandlerFunc {
+func (s *Server) ReportHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(400)
 			fmt.Fprint(w, "Not a POST request")
 			return
 		}
+		var req ReportRequest
 		dec := json.NewDecoder(r.Body)
 		dec.UseNumber()
-		var req RecommendationRequest
 		if err := dec.Decode(&req); err != nil {
 			w.WriteHeader(401)
-			fmt.Fprintf(w, "Error parsing request: %v", err)
+			fmt.Fprintf(w, "Error decoding request: %v", err)
 			return
 		}
-		recs := make(map[EmojiContent]struct{})
-		switch int(math.Round(req.LocalTime)) % 24 {
-		case 6, 7, 8, 9:
-			recs = map[EmojiContent]struct{}{
-				"🥞🍳🥓":  struct{}{},
-				"🫖'🥐🌅": struct{}{},
-				"🏃🌄🚲":  struct{}{},
-				"💪🤸💪":  struct{}{},
-				"☕️🍩🥣": struct{}{},
-			}
-		case 10, 11:
-			recs = map[EmojiContent]struct{}{
-				"💻📝🎧": struct{}{},
-			}
-		case 12, 13:
-			recs = map[EmojiContent]struct{}{
-				"🍕🍔🌯": struct{}{},
-				"🥗🥙🍲": struct{}{},
-				"🍱🍚🍛": struct{}{},
-			}
-		case 14, 15:
-			recs = map[EmojiContent]struct{}{
-				"💻📝🎧": struct{}{},
-			}
-		case 16, 17:
-			recs = map[EmojiContent]struct{}{
-				"🏀🎾🏐": struct{}{},
-				"🎥🕴🎦": struct{}{},
-				"💻📝🎧": struct{}{},
-			}
-		case 18, 19:
-			recs = map[EmojiContent]struct{}{
-				"🍕🍔🌯": struct{}{},
-				"🥗🥙🍲": struct{}{},
-				"🍱🍚🍛": struct{}{},
-			}
-		case 21, 22:
-			recs = map[EmojiContent]struct{}{
-				"🍷🎉🍹": struct{}{},
-				"🍰🍦🍡": struct{}{},
-			}
-		case 23, 0, 1:
-			recs = map[EmojiContent]struct{}{
-				"🌌🚶🌃": struct{}{},
-			}
-		}
-		if recs == nil {
-			recs = make(map[EmojiContent]struct{})
-		}
-		for _, v := range s.FindNearRecommendations(10, req.LocalTime) {
-			recs[v] = struct{}{}
-		}
-		var resp RecommendationResponse
-		for rec := range recs {
-			resp.Recommendations = append(resp.Recommendations, rec)
+		user := UserFromContext(r.Context())
+		if req.Reason = strings.TrimSpace(req.Reason); len(req.Reason) > maxReportReasonLength {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Reason must be at most %d characters", maxReportReasonLength)
+			return
 		}
-		for i := range resp.Recommendations {
-			j := rand.Intn(i + 1)
-			resp.Recommendations[i], resp.Recommendations[j] = resp.Recommendations[j], resp.Recommendations[i]
+		_, err := s.report(context.Background(), user.Uuid, req.Kind, req.Target, req.Reason)
+		if err == errNoReportTarget {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err)
+			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to save report: %v", err)
+			return
 		}
-		resp.Recommendations = resp.Recommendations[:5]
-
-		enc := json.NewEncoder(w)
-		enc.Encode(resp)
+		w.WriteHeader(200)
 		return
 	}
 }
 
-func (s *Server) FriendHandler() http.HandlerFunc {
+func (s *Server) AdminHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(400)
 			fmt.Fprint(w, "Not a POST request")
 			return
 		}
-		var fp FriendRequest
+		var req AdminRequest
 		dec := json.NewDecoder(r.Body)
 		dec.UseNumber()
-		if err := dec.Decode(&fp); err != nil {
-			w.WriteHeader(401)
+		if err := dec.Decode(&req); err != nil {
+			w.WriteHeader(400)
 			fmt.Fprintf(w, "Error decoding request: %v", err)
 			return
 		}
-		if err := s.ValidateLoginToken(fp.LoginToken); err != nil {
-			w.WriteHeader(401)
-			fmt.Fprintf(w, "Error validating login token: %v", err)
-			return
-		}
-		user, exists := s.UserFor(context.Background(), fp.LoginToken)
-		if !exists {
-			w.WriteHeader(401)
-			fmt.Fprint(w, "User does not exist")
-			return
-		}
+		ctx := context.Background()
 
-		switch fp.Action {
-		case Rmfriend:
-			delete(s.Friends[user.Uuid], fp.Other)
-		case AddFriend:
-			if _, exists := s.Friends[user.Uuid]; !exists {
-				s.Friends[user.Uuid] = map[Uuid]struct{}{}
+		switch req.Kind {
+		case ListReportsOp:
+			reports, err := s.ListReports(ctx)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to get reports: %v", err)
+				return
+			}
+			enc := json.NewEncoder(w)
+			enc.Encode(ListReportsResponse{Reports: reports})
+			return
+		case DismissReport:
+			if err := s.DeleteReport(ctx, req.Target); err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to dismiss report: %v", err)
+				return
+			}
+		case SuspendUser, UnsuspendUser:
+			target, err := s.GetUser(ctx, req.Target)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Error getting user: %v", err)
+				return
+			} else if target == nil {
+				w.WriteHeader(404)
+				fmt.Fprint(w, "User does not exist")
+				return
+			}
+			if err = s.setSuspended(ctx, target.Uuid, req.Kind == SuspendUser); err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to update suspension: %v", err)
+				return
+			}
+		case DeleteGroupAsAdmin:
+			existed, err := s.deleteGroupAsAdmin(ctx, req.Target)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to delete group: %v", err)
+				return
+			} else if !existed {
+				w.WriteHeader(404)
+				fmt.Fprint(w, "Group does not exist")
+				return
 			}
-			s.Friends[user.Uuid][fp.Other] = struct{}{}
 		default:
 			w.WriteHeader(404)
-			fmt.Fprint(w, "Unknown friend action")
+			fmt.Fprintf(w, "Unknown admin op %v", req.Kind)
 			return
 		}
 		w.WriteHeader(200)
@@ -727,20 +1314,13 @@ func (s *Server) SendMsgHandler() http.HandlerFunc {
 			fmt.Fprintf(w, "Error decoding request: %v", err)
 			return
 		}
-		if err := s.ValidateLoginToken(req.LoginToken); err != nil {
-			w.WriteHeader(401)
-			fmt.Fprintf(w, "Error validating login token: %v", err)
-			return
-		}
-		user, exists := s.UserFor(context.Background(), req.LoginToken)
-		if !exists {
-			w.WriteHeader(401)
-			fmt.Fprint(w, "Could not find user sending message")
-			return
-		}
+		user := UserFromContext(r.Context())
 
 		msg := &req.Message
-		msg.Source = *user
+		msg.Source = user.Public()
+		if msg.TTL == 0 {
+			msg.TTL = user.DefaultTTL
+		}
 		var err error
 		if msg.Uuid, err = generateUuid(); err != nil {
 			w.WriteHeader(500)
@@ -751,6 +1331,11 @@ func (s *Server) SendMsgHandler() http.HandlerFunc {
 		var uuids []Uuid
 		switch req.RecipientKind {
 		case MsgGroup:
+			if s.Unverified.GroupMessages && !user.Verified {
+				w.WriteHeader(403)
+				fmt.Fprint(w, "Verify your email before sending messages to groups")
+				return
+			}
 			group, err := s.GetGroup(context.Background(), req.To)
 			if err != nil {
 				w.WriteHeader(500)
@@ -761,42 +1346,83 @@ func (s *Server) SendMsgHandler() http.HandlerFunc {
 				fmt.Fprint(w, "Group does not exist")
 				return
 			}
+			if !group.IsMember(user.Uuid) {
+				w.WriteHeader(403)
+				fmt.Fprint(w, errNotGroupMember)
+				return
+			}
+			blocked, err := s.blockSet(context.Background(), user.Uuid)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to get blocked users: %v", err)
+				return
+			}
 			msg.SentTo = group.Name
 			msg.Group = group.Uuid
-			if !exists {
-				w.WriteHeader(401)
-				fmt.Fprint(w, "Group does not exist")
+			if err = s.AddMessage(context.Background(), msg); err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to save message: %v", err)
 				return
 			}
-			msg.SentTo = group.Name
-			s.AddMessage(context.Background(), msg)
 			for userUuid := range group.Users {
 				if userUuid == msg.Source.Uuid {
 					continue
 				}
-				if s.UserToMessages[userUuid] == nil {
-					s.UserToMessages[userUuid] = map[Uuid]struct{}{}
+				if _, isBlocked := blocked[userUuid]; isBlocked {
+					continue
+				}
+				if err = s.AddToInbox(context.Background(), userUuid, msg); err != nil {
+					// TODO log error here
+					continue
 				}
-				s.UserToMessages[userUuid][msg.Uuid] = struct{}{}
 				uuids = append(uuids, userUuid)
 			}
 		case MsgFriend:
-			user, err := s.GetUser(context.Background(), req.To)
+			recipient, err := s.GetUser(context.Background(), req.To)
 			if err != nil {
 				w.WriteHeader(500)
 				fmt.Fprintf(w, "Error getting user: %v", err)
 				return
-			} else if user == nil {
+			} else if recipient == nil {
 				w.WriteHeader(401)
 				fmt.Fprint(w, "User does not exist")
 				return
 			}
-			msg.SentTo = user.Name
-			s.AddMessage(context.Background(), msg)
-			if s.UserToMessages[req.To] == nil {
-				s.UserToMessages[req.To] = map[Uuid]struct{}{}
+			blocked, err := s.blockedBetween(context.Background(), user.Uuid, recipient.Uuid)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to check blocked users: %v", err)
+				return
+			} else if blocked {
+				w.WriteHeader(403)
+				fmt.Fprint(w, errBlocked)
+				return
+			}
+			accepts, err := s.acceptsMessagesFrom(context.Background(), recipient, user.Uuid)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to check who %s accepts messages from: %v", recipient.Name, err)
+				return
+			} else if !accepts {
+				w.WriteHeader(403)
+				if recipient.DirectMessages == DMFriends {
+					fmt.Fprintf(w, "%s only accepts messages from friends", recipient.Name)
+				} else {
+					fmt.Fprintf(w, "%s only accepts messages from friends and their friends", recipient.Name)
+				}
+				return
+			}
+			msg.SentTo = recipient.Name
+			if err = s.AddMessage(context.Background(), msg); err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to save message: %v", err)
+				return
+			}
+			if err = s.AddToInbox(context.Background(), req.To, msg); err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Failed to deliver message: %v", err)
+				return
 			}
-			s.UserToMessages[req.To][msg.Uuid] = struct{}{}
 			uuids = []Uuid{req.To}
 		default:
 			w.WriteHeader(404)
@@ -805,7 +1431,7 @@ func (s *Server) SendMsgHandler() http.HandlerFunc {
 		}
 
 		go s.LogEmojiContent(msg.Emojis, msg.LocalTime)
-		go s.sendMessagePushNotification(uuids, user.Name, msg.Emojis, msg.Location)
+		go s.sendMessagePushNotification(user.Uuid, uuids, user.Name, msg.Emojis, msg.Location)
 
 		w.WriteHeader(200)
 		return
@@ -813,22 +1439,13 @@ func (s *Server) SendMsgHandler() http.HandlerFunc {
 }
 
 func (s *Server) sendMessagePushNotification(
+	from Uuid,
 	uuids []Uuid,
 	name string,
 	emojis EmojiContent,
 	location string,
 ) {
-	var to []expo.ExponentPushToken
-	for _, uuid := range uuids {
-		notifToken, err := s.RedisClient.HGet(context.Background(), "user_notif_tokens", uuid.String()).Result()
-		if err != nil {
-			fmt.Printf("Failed to get user notif token: %v", err)
-			continue
-		} else if notifToken == "" {
-			continue
-		}
-		to = append(to, expo.ExponentPushToken(notifToken))
-	}
+	to := s.notifTokensFor(context.Background(), from, uuids)
 	if len(to) == 0 {
 		return
 	}
@@ -838,21 +1455,7 @@ func (s *Server) sendMessagePushNotification(
 	} else {
 		pushBody = fmt.Sprintf("%s: %s❓ @ %s", name, emojis, location)
 	}
-	pushMsg := expo.PushMessage{
-		To:       to,
-		Body:     pushBody,
-		Sound:    "default",
-		Title:    "📨‼️",
-		Priority: expo.DefaultPriority,
-	}
-	client := expo.NewPushClient(nil)
-	resp, err := client.Publish(&pushMsg)
-	if err != nil {
-		fmt.Println(err)
-	}
-	if resp.ValidateResponse() != nil {
-		fmt.Println("Failed to send push notification")
-	}
+	sendPush(to, "📨‼️", pushBody)
 }
 
 func (s *Server) PushNotifTokenHandler() http.HandlerFunc {
@@ -875,19 +1478,7 @@ func (s *Server) PushNotifTokenHandler() http.HandlerFunc {
 			fmt.Fprint(w, "Cannot send empty notification token")
 			return
 		}
-		token := req.LoginToken
-		if err := s.ValidateLoginToken(token); err != nil {
-			w.WriteHeader(401)
-			fmt.Fprintf(w, "Error validating login token: %v", err)
-			return
-		}
-
-		user, exists := s.UserFor(context.Background(), token)
-		if !exists {
-			w.WriteHeader(401)
-			fmt.Fprint(w, "User does not exist")
-			return
-		}
+		user := UserFromContext(r.Context())
 
 		switch req.Kind {
 		case AddNotifToken:
@@ -897,20 +1488,26 @@ func (s *Server) PushNotifTokenHandler() http.HandlerFunc {
 				fmt.Fprintf(w, "Error parsing expo token: %v", err)
 				return
 			}
-			err = s.RedisClient.HSet(
-				context.Background(), "user_notif_tokens", user.Uuid.String(), string(expoToken),
-			).Err()
+			err = s.SetNotifToken(context.Background(), user.Uuid, string(expoToken))
 			if err != nil {
 				w.WriteHeader(500)
 				fmt.Fprintf(w, "Failed to save notification setting: %v", err)
 				return
 			}
+			if session := SessionFromContext(r.Context()); session != nil {
+				err = s.updateSession(context.Background(), session.Uuid, func(session *Session) {
+					session.NotifToken = string(expoToken)
+				})
+				if err != nil {
+					w.WriteHeader(500)
+					fmt.Fprintf(w, "Failed to save notification setting: %v", err)
+					return
+				}
+			}
 
 			w.WriteHeader(200)
 		case RmNotifToken:
-			err := s.RedisClient.HDel(
-				context.Background(), "user_notif_tokens", user.Uuid.String(),
-			).Err()
+			err := s.DeleteNotifToken(context.Background(), user.Uuid)
 			if err != nil {
 				w.WriteHeader(500)
 				fmt.Fprintf(w, "Failed to save notification setting: %v", err)
@@ -941,51 +1538,37 @@ func (s *Server) RecvMsgHandler() http.HandlerFunc {
 			fmt.Fprintf(w, "Error decoding request: %v", err)
 			return
 		}
-		token := req.LoginToken
-		if err := s.ValidateLoginToken(token); err != nil {
-			w.WriteHeader(401)
-			fmt.Fprintf(w, "Error validating login token: %v", err)
+		user := UserFromContext(r.Context())
+
+		var out RecvMsgResponse
+		messages, err := s.InboxMessages(context.Background(), user.Uuid)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to get messages: %v", err)
 			return
 		}
-		user, exists := s.UserFor(context.Background(), token)
-		if !exists {
-			w.WriteHeader(401)
-			fmt.Fprint(w, "User does not exist")
+		replies, err := s.ListRepliesForUser(context.Background(), user.Uuid)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to get replies: %v", err)
 			return
 		}
-
-		var out RecvMsgResponse
-		now := time.Now()
-
-		for uuid := range s.UserToMessages[user.Uuid] {
-			msg, err := s.GetMessage(context.Background(), uuid)
-			if err != nil {
-				// TODO report error here
-				continue
-			} else if msg == nil {
-				continue
-			} else if msg.Expired(now) {
-				s.DeleteMessage(context.Background(), uuid)
-				continue
-			}
-			out.NewMessages = append(out.NewMessages, msg)
+		// Leave out anything which arrived before its sender was blocked.
+		blocked, err := s.blockSet(context.Background(), user.Uuid)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Failed to get blocked users: %v", err)
+			return
 		}
-		for _, uuid := range s.UserToReplies[user.Uuid] {
-			reply, replyExists := s.Replies[uuid]
-			if !replyExists {
-				continue
+		for _, msg := range messages {
+			if _, isBlocked := blocked[msg.Source.Uuid]; !isBlocked {
+				out.NewMessages = append(out.NewMessages, msg)
 			}
-			msg, err := s.MessageForReply(context.Background(), reply)
-			if err != nil {
-				// TODO report error here
-				continue
-			} else if msg == nil {
-				continue
-			} else if msg.Expired(now) {
-				s.DeleteMessage(context.Background(), uuid)
-				continue
+		}
+		for _, reply := range replies {
+			if _, isBlocked := blocked[reply.From.Uuid]; !isBlocked {
+				out.NewReplies = append(out.NewReplies, reply)
 			}
-			out.NewReplies = append(out.NewReplies, reply)
 		}
 		enc := json.NewEncoder(w)
 		if err := enc.Encode(out); err != nil {
@@ -995,8 +1578,8 @@ func (s *Server) RecvMsgHandler() http.HandlerFunc {
 		}
 		// if success then empty out the messages
 		if req.DeleteOld {
-			s.UserToMessages[user.Uuid] = nil
-			s.UserToReplies[user.Uuid] = nil
+			s.ClearInbox(context.Background(), user.Uuid)
+			s.ClearRepliesForUser(context.Background(), user.Uuid)
 		}
 		return
 	}
@@ -1013,75 +1596,12 @@ func (s *Server) SummaryHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		<-buffer
 		defer func() { buffer <- struct{}{} }()
-		ctx := context.Background()
-		emojisSent, err := s.RedisClient.HGetAll(ctx, "emojis_sent").Result()
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "Failed to get counts: %v", err)
-			return
-		}
-		emojisSentAt, err := s.RedisClient.HGetAll(ctx, "emoji_sent_at").Result()
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "Failed to get times: %v", err)
-			return
-		}
-		repliesSent, err := s.RedisClient.HGetAll(ctx, "emoji_reply").Result()
+		out, err := s.Summary(context.Background())
 		if err != nil {
 			w.WriteHeader(500)
-			fmt.Fprintf(w, "Failed to get replies: %v", err)
+			fmt.Fprint(w, err)
 			return
 		}
-		out := SummaryResponse{
-			Counts:         make(map[string]int, len(emojisSent)),
-			Times:          make(map[string]float64, len(emojisSentAt)),
-			ReplyCounts:    make(map[string]int, len(repliesSent)),
-			MessageReplies: map[string]map[string]int{},
-		}
-		for emojis, count := range emojisSent {
-			out.Counts[emojis], err = strconv.Atoi(count)
-			if err != nil {
-				fmt.Printf("Failed to parse count: %v", err)
-				continue
-			}
-		}
-		for emojis, sentAt := range emojisSentAt {
-			out.Times[emojis], err = strconv.ParseFloat(sentAt, 64)
-			if err != nil {
-				fmt.Printf("Failed to parse time: %v", err)
-				continue
-			}
-		}
-		for replies, count := range repliesSent {
-			out.ReplyCounts[replies], err = strconv.Atoi(count)
-			if err != nil {
-				fmt.Printf("Failed to parse reply count: %v", err)
-				continue
-			}
-		}
-		emojiKeys, err := s.RedisClient.Keys(ctx, "emojis_*").Result()
-		if err == nil {
-			for _, key := range emojiKeys {
-				var emojiString string
-				_, err := fmt.Sscanf(key, "emojis_%s", &emojiString)
-				if err != nil {
-					continue
-				}
-				replyCounts := map[string]int{}
-				replyPairs, err := s.RedisClient.HGetAll(ctx, key).Result()
-				if err != nil {
-					continue
-				}
-				for reply, count := range replyPairs {
-					count, err := strconv.Atoi(count)
-					if err != nil {
-						continue
-					}
-					replyCounts[reply] = count
-				}
-				out.MessageReplies[emojiString] = replyCounts
-			}
-		}
 
 		enc := json.NewEncoder(w)
 		enc.Encode(out)
@@ -1091,7 +1611,7 @@ func (s *Server) SummaryHandler() http.HandlerFunc {
 
 func (s *Server) ResetRedis() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := s.RedisClient.FlushAll(context.Background()).Err(); err != nil {
+		if err := s.Reset(context.Background()); err != nil {
 			w.WriteHeader(500)
 			fmt.Fprintf(w, "Failed to flush database: %v", err)
 			return
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// How long an invite lasts when no duration is given.
+	defaultInviteDuration = 7 * 24 * time.Hour
+	maxInviteDuration     = 30 * 24 * time.Hour
+)
+
+var errInvalidInvite = errors.New("Invite is invalid or has expired")
+
+var inviteCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Generates a code for an invite, which is short enough to be typed in by hand.
+func generateInviteCode() (string, error) {
+	code := [10]byte{}
+	if _, err := rand.Read(code[:]); err != nil {
+		return "", err
+	}
+	return inviteCodeEncoding.EncodeToString(code[:]), nil
+}
+
+// Invite codes are not case sensitive, so that they can be typed in however.
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Creates an invite to a group on behalf of one of its admins. A maxUses of 0 allows any number
+// of uses, and a duration of 0 uses the default.
+func (s *Server) createGroupInvite(
+	ctx context.Context, admin, groupUuid Uuid, maxUses int, duration time.Duration,
+) (*GroupInvite, error) {
+	if duration == 0 {
+		duration = defaultInviteDuration
+	}
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return nil, err
+	} else if group == nil {
+		return nil, errNoGroup
+	} else if !group.IsAdmin(admin) {
+		return nil, errNotGroupAdmin
+	}
+	code, err := generateInviteCode()
+	if err != nil {
+		return nil, err
+	}
+	invite := &GroupInvite{
+		Code:       code,
+		Group:      groupUuid,
+		CreatedBy:  admin,
+		MaxUses:    maxUses,
+		ValidUntil: time.Now().Add(duration).Unix(),
+	}
+	return invite, s.AddGroupInvite(ctx, invite)
+}
+
+// Returns the invites to a group, which only its admins can see.
+func (s *Server) groupInvites(ctx context.Context, admin, groupUuid Uuid) ([]GroupInvite, error) {
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return nil, err
+	} else if group == nil {
+		return nil, errNoGroup
+	} else if !group.IsAdmin(admin) {
+		return nil, errNotGroupAdmin
+	}
+	return s.GroupInvites(ctx, groupUuid)
+}
+
+func (s *Server) revokeGroupInvite(ctx context.Context, admin, groupUuid Uuid, code string) error {
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return err
+	} else if group == nil {
+		return errNoGroup
+	} else if !group.IsAdmin(admin) {
+		return errNotGroupAdmin
+	}
+	invite, err := s.GetGroupInvite(ctx, normalizeInviteCode(code))
+	if err != nil {
+		return err
+	} else if invite == nil || invite.Group != groupUuid {
+		return errInvalidInvite
+	}
+	return s.DeleteGroupInvite(ctx, groupUuid, invite.Code)
+}
+
+// Returns the invite to group with code, or errInvalidInvite if there is none which can be used.
+func (s *Server) groupInviteFor(ctx context.Context, group *Group, code string) (*GroupInvite, error) {
+	invite, err := s.GetGroupInvite(ctx, normalizeInviteCode(code))
+	if err != nil {
+		return nil, err
+	} else if invite == nil || invite.Group != group.Uuid || invite.Expired() {
+		return nil, errInvalidInvite
+	}
+	return invite, nil
+}
+
+// Uses up one use of an invite, deleting it once it has none left. The lock for its group must
+// be held since it was looked up.
+func (s *Server) useGroupInvite(ctx context.Context, invite *GroupInvite) error {
+	invite.Uses++
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		return s.DeleteGroupInvite(ctx, invite.Group, invite.Code)
+	}
+	return s.AddGroupInvite(ctx, invite)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	errNoJoinRequest  = errors.New("No such request to join the group")
+	errGroupNotLocked = errors.New("Group is not locked, so it can be joined without asking")
+)
+
+// Asks the admins of a locked group to let user join it. Returns the group, and whether a new
+// request was made, which is false if the user had already asked.
+func (s *Server) requestToJoinGroup(ctx context.Context, user *User, groupUuid Uuid) (*Group, bool, error) {
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return nil, false, err
+	} else if group == nil {
+		return nil, false, errNoGroup
+	} else if group.IsMember(user.Uuid) {
+		return group, false, nil
+	} else if !group.Locked {
+		return nil, false, errGroupNotLocked
+	}
+	if banned, err := s.IsBannedFromGroup(ctx, groupUuid, user.Uuid); err != nil {
+		return nil, false, err
+	} else if banned {
+		return nil, false, errBannedFromGroup
+	}
+	requested, err := s.HasJoinRequest(ctx, groupUuid, user.Uuid)
+	if err != nil || requested {
+		return group, false, err
+	}
+	return group, true, s.AddJoinRequest(ctx, groupUuid, user.Uuid, time.Now().Unix())
+}
+
+// Returns who has asked to join a group, which only its admins can see.
+func (s *Server) joinRequests(ctx context.Context, admin, groupUuid Uuid) ([]PublicUser, error) {
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return nil, err
+	} else if group == nil {
+		return nil, errNoGroup
+	} else if !group.IsAdmin(admin) {
+		return nil, errNotGroupAdmin
+	}
+	uuids, err := s.JoinRequests(ctx, groupUuid)
+	if err != nil {
+		return nil, err
+	}
+	return s.usersFor(ctx, uuids)
+}
+
+// Approves or rejects the request of user to join a group on behalf of one of its admins.
+// Returns the group as it was left.
+func (s *Server) answerJoinRequest(ctx context.Context, admin, groupUuid, user Uuid, approve bool) (*Group, error) {
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil {
+		return nil, err
+	} else if group == nil {
+		return nil, errNoGroup
+	} else if !group.IsAdmin(admin) {
+		return nil, errNotGroupAdmin
+	}
+	requested, err := s.HasJoinRequest(ctx, groupUuid, user)
+	if err != nil {
+		return nil, err
+	} else if !requested {
+		return nil, errNoJoinRequest
+	}
+	if !approve {
+		return group, s.DeleteJoinRequest(ctx, groupUuid, user)
+	}
+	requester, err := s.GetUser(ctx, user)
+	if err != nil {
+		return nil, err
+	} else if requester == nil {
+		if err = s.DeleteJoinRequest(ctx, groupUuid, user); err != nil {
+			return nil, err
+		}
+		return nil, errNoJoinRequest
+	}
+	return group, s.addToGroup(ctx, group, requester)
+}
+
+// Returns who can administer a group.
+func groupAdmins(group *Group) []Uuid {
+	admins := make([]Uuid, 0, len(group.Admins)+1)
+	for uuid := range group.Users {
+		if group.IsAdmin(uuid) {
+			admins = append(admins, uuid)
+		}
+	}
+	return admins
+}
+
+func (s *Server) sendJoinRequestPushNotification(group *Group, requester *User) {
+	tokens := s.notifTokensFor(context.Background(), requester.Uuid, groupAdmins(group))
+	if len(tokens) == 0 {
+		return
+	}
+	sendPush(tokens, "👥❓", fmt.Sprintf("👋 %s ➡️ %s ❓", requester.Name, group.Name))
+}
+
+// Tells user whether they were let into a group they asked to join.
+func (s *Server) sendJoinRequestAnsweredPushNotification(group *Group, user Uuid, approved bool) {
+	tokens := s.notifTokensFor(context.Background(), InvalidUuid, []Uuid{user})
+	if len(tokens) == 0 {
+		return
+	}
+	title, body := "👥❌", fmt.Sprintf("%s ❌", group.Name)
+	if approved {
+		title, body = "👥✅", fmt.Sprintf("🎉 %s ✅", group.Name)
+	}
+	sendPush(tokens, title, body)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Mailer delivers emails to users, such as codes for resetting their password.
+type Mailer interface {
+	SendMail(to Email, subject, body string) error
+}
+
+// Picks a Mailer from the environment. Mail is sent over SMTP if MOJI_SMTP_ADDR is set. For local
+// development, MOJI_MAIL_LOG can instead name a file to append mail to, or be "stdout" to print
+// it. Since mail holds codes which log users in, it is never logged unless asked for, and without
+// either no mail can be sent.
+func NewMailer() Mailer {
+	if addr := os.Getenv("MOJI_SMTP_ADDR"); addr != "" {
+		mailer := &SMTPMailer{Addr: addr, From: os.Getenv("MOJI_MAIL_FROM")}
+		if user := os.Getenv("MOJI_SMTP_USER"); user != "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			mailer.Auth = smtp.PlainAuth("", user, os.Getenv("MOJI_SMTP_PASSWORD"), host)
+		}
+		return mailer
+	}
+	switch path := os.Getenv("MOJI_MAIL_LOG"); path {
+	case "":
+		fmt.Println("No mailer configured, emails cannot be sent")
+	case "stdout":
+		return &LogMailer{W: os.Stdout}
+	default:
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err == nil {
+			return &LogMailer{W: f}
+		}
+		fmt.Printf("Failed to open mail log %q, emails cannot be sent: %v\n", path, err)
+	}
+	return noMailer{}
+}
+
+var errNoMailer = errors.New("Sending email is not configured")
+
+// noMailer refuses to send any mail, for when no way of sending it is configured.
+type noMailer struct{}
+
+func (noMailer) SendMail(Email, string, string) error {
+	return errNoMailer
+}
+
+// SMTPMailer sends mail through an SMTP server.
+type SMTPMailer struct {
+	// host:port of the SMTP server.
+	Addr string
+	From string
+	// May be nil if the server does not require authentication.
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) SendMail(to Email, subject, body string) error {
+	if strings.ContainsAny(string(to)+subject, "\r\n") {
+		return fmt.Errorf("Mail headers must not contain newlines")
+	}
+	msg := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		m.From, to, subject, body,
+	)
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{string(to)}, []byte(msg))
+}
+
+// LogMailer writes mail to W instead of sending it, for local development and tests.
+type LogMailer struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+func (m *LogMailer) SendMail(to Email, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.W, "To: %s\nSubject: %s\n\n%s\n\n", to, subject, body)
+	return err
+}
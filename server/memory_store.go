@@ -0,0 +1,1034 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store which keeps everything in memory, for tests and local development
+// without redis. Records are kept marshalled so callers never share them.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	// email -> uuid of users who have signed up
+	signedUp       map[Email]Uuid
+	hashedPassword map[Uuid]string
+	users          map[Uuid][]byte
+	sessions       map[Uuid][]byte
+	userSessions   map[Uuid]map[Uuid]struct{}
+	notifTokens    map[Uuid]string
+	emailCodes     map[emailCodeKey]expiringEntry
+	// user -> unix timestamp before which their tokens are invalid
+	tokensValidAfter map[Uuid]int64
+
+	friends   map[Uuid]map[Uuid]struct{}
+	blocked   map[Uuid]map[Uuid]struct{}
+	blockedBy map[Uuid]map[Uuid]struct{}
+	// user -> other user -> when the request was sent
+	incomingFriendRequests map[Uuid]map[Uuid]int64
+	outgoingFriendRequests map[Uuid]map[Uuid]int64
+	groups                 map[Uuid][]byte
+	groupUsers             map[Uuid]map[Uuid]struct{}
+	groupBans              map[Uuid]map[Uuid]struct{}
+	// group -> user -> when they asked to join
+	joinRequests map[Uuid]map[Uuid]int64
+	// user -> groups they were added to, banned from or asked to join
+	userGroups map[Uuid]map[Uuid]struct{}
+	// invite code -> invite
+	groupInvites map[string]expiringEntry
+	// group -> codes of its invites
+	groupInviteCodes map[Uuid]map[string]struct{}
+
+	messages map[Uuid]expiringEntry
+	replies  map[Uuid]expiringEntry
+	// recipient -> message or reply uuid -> when it was sent
+	inboxes      map[Uuid]map[Uuid]int64
+	replyQueues  map[Uuid]map[Uuid]int64
+	reports      map[Uuid][]byte
+	emojisSent   map[EmojiContent]int
+	emojiSentAt  map[EmojiContent]float64
+	replyCounts  map[EmojiReply]int
+	emojiReplies map[EmojiContent]map[EmojiReply]int
+}
+
+type emailCodeKey struct {
+	kind EmailCodeKind
+	user Uuid
+}
+
+// A marshalled value which should be treated as missing after expiresAt, unless it is zero.
+type expiringEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	ms := &MemoryStore{}
+	ms.reset()
+	return ms
+}
+
+// reset clears everything in the store. mu must be held, or the store not yet shared.
+func (ms *MemoryStore) reset() {
+	ms.signedUp = map[Email]Uuid{}
+	ms.hashedPassword = map[Uuid]string{}
+	ms.users = map[Uuid][]byte{}
+	ms.sessions = map[Uuid][]byte{}
+	ms.userSessions = map[Uuid]map[Uuid]struct{}{}
+	ms.notifTokens = map[Uuid]string{}
+	ms.emailCodes = map[emailCodeKey]expiringEntry{}
+	ms.tokensValidAfter = map[Uuid]int64{}
+	ms.friends = map[Uuid]map[Uuid]struct{}{}
+	ms.incomingFriendRequests = map[Uuid]map[Uuid]int64{}
+	ms.blocked = map[Uuid]map[Uuid]struct{}{}
+	ms.blockedBy = map[Uuid]map[Uuid]struct{}{}
+	ms.outgoingFriendRequests = map[Uuid]map[Uuid]int64{}
+	ms.groups = map[Uuid][]byte{}
+	ms.groupUsers = map[Uuid]map[Uuid]struct{}{}
+	ms.groupBans = map[Uuid]map[Uuid]struct{}{}
+	ms.joinRequests = map[Uuid]map[Uuid]int64{}
+	ms.userGroups = map[Uuid]map[Uuid]struct{}{}
+	ms.groupInvites = map[string]expiringEntry{}
+	ms.groupInviteCodes = map[Uuid]map[string]struct{}{}
+	ms.messages = map[Uuid]expiringEntry{}
+	ms.replies = map[Uuid]expiringEntry{}
+	ms.inboxes = map[Uuid]map[Uuid]int64{}
+	ms.replyQueues = map[Uuid]map[Uuid]int64{}
+	ms.reports = map[Uuid][]byte{}
+	ms.emojisSent = map[EmojiContent]int{}
+	ms.emojiSentAt = map[EmojiContent]float64{}
+	ms.replyCounts = map[EmojiReply]int{}
+	ms.emojiReplies = map[EmojiContent]map[EmojiReply]int{}
+}
+
+func (ms *MemoryStore) Reset(context.Context) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.reset()
+	return nil
+}
+
+// Adds uuid to the set kept for key in sets.
+func addToSet(sets map[Uuid]map[Uuid]struct{}, key, uuid Uuid) {
+	if sets[key] == nil {
+		sets[key] = map[Uuid]struct{}{}
+	}
+	sets[key][uuid] = struct{}{}
+}
+
+// Returns the uuids in a set, sorted so that results are stable.
+func setMembers(set map[Uuid]struct{}) []Uuid {
+	out := make([]Uuid, 0, len(set))
+	for uuid := range set {
+		out = append(out, uuid)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// Returns the uuids in a sorted set ordered by their score.
+func sortedSetMembers(set map[Uuid]int64) []Uuid {
+	out := make([]Uuid, 0, len(set))
+	for uuid := range set {
+		out = append(out, uuid)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if set[out[i]] == set[out[j]] {
+			return out[i] < out[j]
+		}
+		return set[out[i]] < set[out[j]]
+	})
+	return out
+}
+
+func (ms *MemoryStore) CreateUser(_ context.Context, user *User, hashedPassword string) error {
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal user: %v", err)
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, exists := ms.signedUp[user.Email]; exists {
+		return ErrUserExists
+	}
+	ms.signedUp[user.Email] = user.Uuid
+	ms.hashedPassword[user.Uuid] = hashedPassword
+	ms.users[user.Uuid] = userJSON
+	return nil
+}
+
+func (ms *MemoryStore) UserByEmail(ctx context.Context, email Email) (*User, error) {
+	ms.mu.Lock()
+	uuid, exists := ms.signedUp[email]
+	ms.mu.Unlock()
+	if !exists {
+		return nil, nil
+	}
+	return ms.GetUser(ctx, uuid)
+}
+
+func (ms *MemoryStore) PasswordHash(_ context.Context, user Uuid) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.hashedPassword[user], nil
+}
+
+func (ms *MemoryStore) SetPasswordHash(_ context.Context, user Uuid, hashedPassword string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.hashedPassword[user] = hashedPassword
+	return nil
+}
+
+func (ms *MemoryStore) AddUser(_ context.Context, user *User) error {
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.users[user.Uuid] = userJSON
+	return nil
+}
+
+func (ms *MemoryStore) GetUser(_ context.Context, uuid Uuid) (*User, error) {
+	ms.mu.Lock()
+	userJSON, exists := ms.users[uuid]
+	ms.mu.Unlock()
+	if !exists {
+		return nil, nil
+	}
+	var user User
+	if err := json.Unmarshal(userJSON, &user); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal user: %v", err)
+	}
+	return &user, nil
+}
+
+func (ms *MemoryStore) DeleteUser(_ context.Context, user *User) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.users, user.Uuid)
+	delete(ms.signedUp, user.Email)
+	delete(ms.hashedPassword, user.Uuid)
+	delete(ms.notifTokens, user.Uuid)
+	delete(ms.tokensValidAfter, user.Uuid)
+	for session := range ms.userSessions[user.Uuid] {
+		delete(ms.sessions, session)
+	}
+	delete(ms.userSessions, user.Uuid)
+	delete(ms.friends, user.Uuid)
+	delete(ms.incomingFriendRequests, user.Uuid)
+	delete(ms.blocked, user.Uuid)
+	delete(ms.blockedBy, user.Uuid)
+	delete(ms.outgoingFriendRequests, user.Uuid)
+	delete(ms.inboxes, user.Uuid)
+	delete(ms.replyQueues, user.Uuid)
+	delete(ms.userGroups, user.Uuid)
+	delete(ms.emailCodes, emailCodeKey{PasswordResetCode, user.Uuid})
+	delete(ms.emailCodes, emailCodeKey{VerifyEmailCode, user.Uuid})
+	return nil
+}
+
+func (ms *MemoryStore) AnonymizeUser(_ context.Context, user Uuid, anon PublicUser) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for uuid, entry := range ms.messages {
+		var msg Message
+		if err := json.Unmarshal(entry.value, &msg); err != nil {
+			return err
+		} else if msg.Source.Uuid != user {
+			continue
+		}
+		msg.Source = anon
+		msgJSON, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		ms.messages[uuid] = expiringEntry{value: msgJSON, expiresAt: entry.expiresAt}
+	}
+	for uuid, entry := range ms.replies {
+		var reply MessageReply
+		if err := json.Unmarshal(entry.value, &reply); err != nil {
+			return err
+		}
+		changed := false
+		if reply.From.Uuid == user {
+			reply.From = anon
+			changed = true
+		}
+		if reply.Message != nil && reply.Message.Source.Uuid == user {
+			reply.Message.Source = anon
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		replyJSON, err := json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		ms.replies[uuid] = expiringEntry{value: replyJSON, expiresAt: entry.expiresAt}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetUsers(_ context.Context) ([]User, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if len(ms.users) == 0 {
+		return nil, nil
+	}
+	out := make([]User, 0, len(ms.users))
+	for _, userJSON := range ms.users {
+		var user User
+		if err := json.Unmarshal(userJSON, &user); err != nil {
+			return nil, err
+		}
+		out = append(out, user)
+	}
+	return out, nil
+}
+
+// Login tokens from before sessions only ever existed in redis.
+func (ms *MemoryStore) LegacyLoginToken(context.Context, Email) (*LoginToken, error) {
+	return nil, nil
+}
+
+func (ms *MemoryStore) DeleteLegacyLoginToken(context.Context, Email) error {
+	return nil
+}
+
+func (ms *MemoryStore) SetTokensValidAfter(_ context.Context, user Uuid, validAfter int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.tokensValidAfter[user] = validAfter
+	return nil
+}
+
+func (ms *MemoryStore) TokensValidAfter(_ context.Context, user Uuid) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.tokensValidAfter[user], nil
+}
+
+func (ms *MemoryStore) AddSession(_ context.Context, session *Session) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ms.sessions[session.Uuid] = sessionJSON
+	addToSet(ms.userSessions, session.User, session.Uuid)
+	return nil
+}
+
+func (ms *MemoryStore) GetSession(_ context.Context, uuid Uuid) (*Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	sessionJSON, exists := ms.sessions[uuid]
+	if !exists {
+		return nil, nil
+	}
+	var session Session
+	if err := json.Unmarshal(sessionJSON, &session); err != nil {
+		return nil, err
+	}
+	if session.Expired() {
+		delete(ms.sessions, uuid)
+		return nil, nil
+	}
+	return &session, nil
+}
+
+func (ms *MemoryStore) DeleteSession(_ context.Context, user, uuid Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.sessions, uuid)
+	delete(ms.userSessions[user], uuid)
+	return nil
+}
+
+func (ms *MemoryStore) SessionsForUser(_ context.Context, user Uuid) ([]Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var out []Session
+	for _, uuid := range setMembers(ms.userSessions[user]) {
+		sessionJSON, exists := ms.sessions[uuid]
+		var session Session
+		if exists {
+			if err := json.Unmarshal(sessionJSON, &session); err != nil {
+				return nil, err
+			}
+		}
+		if !exists || session.Expired() {
+			delete(ms.sessions, uuid)
+			delete(ms.userSessions[user], uuid)
+			continue
+		}
+		out = append(out, session)
+	}
+	return out, nil
+}
+
+func (ms *MemoryStore) DeleteSessionsForUser(_ context.Context, user Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for uuid := range ms.userSessions[user] {
+		delete(ms.sessions, uuid)
+	}
+	delete(ms.userSessions, user)
+	return nil
+}
+
+func (ms *MemoryStore) SetEmailCode(_ context.Context, kind EmailCodeKind, code *EmailCode) error {
+	codeJSON, err := json.Marshal(code)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.emailCodes[emailCodeKey{kind, code.User}] = expiringEntry{
+		value:     codeJSON,
+		expiresAt: time.Unix(code.ValidUntil, 0),
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetEmailCode(_ context.Context, kind EmailCodeKind, user Uuid) (*EmailCode, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	key := emailCodeKey{kind, user}
+	entry, exists := ms.emailCodes[key]
+	if !exists {
+		return nil, nil
+	} else if entry.expiresAt.Before(time.Now()) {
+		delete(ms.emailCodes, key)
+		return nil, nil
+	}
+	var code EmailCode
+	if err := json.Unmarshal(entry.value, &code); err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+func (ms *MemoryStore) DeleteEmailCode(_ context.Context, kind EmailCodeKind, user Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.emailCodes, emailCodeKey{kind, user})
+	return nil
+}
+
+func (ms *MemoryStore) SetNotifToken(_ context.Context, user Uuid, token string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.notifTokens[user] = token
+	return nil
+}
+
+func (ms *MemoryStore) NotifToken(_ context.Context, user Uuid) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.notifTokens[user], nil
+}
+
+func (ms *MemoryStore) DeleteNotifToken(_ context.Context, user Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.notifTokens, user)
+	return nil
+}
+
+func (ms *MemoryStore) AddFriend(_ context.Context, user, friend Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	addToSet(ms.friends, user, friend)
+	return nil
+}
+
+func (ms *MemoryStore) RemoveFriend(_ context.Context, user, friend Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.friends[user], friend)
+	return nil
+}
+
+func (ms *MemoryStore) IsFriend(_ context.Context, user, friend Uuid) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, exists := ms.friends[user][friend]
+	return exists, nil
+}
+
+func (ms *MemoryStore) ListFriends(_ context.Context, user Uuid) ([]Uuid, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return setMembers(ms.friends[user]), nil
+}
+
+func (ms *MemoryStore) Block(_ context.Context, user, other Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	addToSet(ms.blocked, user, other)
+	addToSet(ms.blockedBy, other, user)
+	return nil
+}
+
+func (ms *MemoryStore) Unblock(_ context.Context, user, other Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.blocked[user], other)
+	delete(ms.blockedBy[other], user)
+	return nil
+}
+
+func (ms *MemoryStore) HasBlocked(_ context.Context, user, other Uuid) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, exists := ms.blocked[user][other]
+	return exists, nil
+}
+
+func (ms *MemoryStore) ListBlocked(_ context.Context, user Uuid) ([]Uuid, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return setMembers(ms.blocked[user]), nil
+}
+
+func (ms *MemoryStore) ListBlockedBy(_ context.Context, user Uuid) ([]Uuid, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return setMembers(ms.blockedBy[user]), nil
+}
+
+func (ms *MemoryStore) AddFriendRequest(_ context.Context, from, to Uuid, sentAt int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.outgoingFriendRequests[from] == nil {
+		ms.outgoingFriendRequests[from] = map[Uuid]int64{}
+	}
+	ms.outgoingFriendRequests[from][to] = sentAt
+	if ms.incomingFriendRequests[to] == nil {
+		ms.incomingFriendRequests[to] = map[Uuid]int64{}
+	}
+	ms.incomingFriendRequests[to][from] = sentAt
+	return nil
+}
+
+func (ms *MemoryStore) DeleteFriendRequest(_ context.Context, from, to Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.outgoingFriendRequests[from], to)
+	delete(ms.incomingFriendRequests[to], from)
+	return nil
+}
+
+func (ms *MemoryStore) HasFriendRequest(_ context.Context, from, to Uuid) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, exists := ms.outgoingFriendRequests[from][to]
+	return exists, nil
+}
+
+func (ms *MemoryStore) IncomingFriendRequests(_ context.Context, user Uuid) ([]Uuid, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return sortedSetMembers(ms.incomingFriendRequests[user]), nil
+}
+
+func (ms *MemoryStore) OutgoingFriendRequests(_ context.Context, user Uuid) ([]Uuid, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return sortedSetMembers(ms.outgoingFriendRequests[user]), nil
+}
+
+func (ms *MemoryStore) AddGroup(_ context.Context, group *Group) error {
+	groupJSON, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.groups[group.Uuid] = groupJSON
+	return nil
+}
+
+func (ms *MemoryStore) DeleteGroup(_ context.Context, uuid Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.groups, uuid)
+	delete(ms.groupUsers, uuid)
+	for code := range ms.groupInviteCodes[uuid] {
+		delete(ms.groupInvites, code)
+	}
+	delete(ms.groupInviteCodes, uuid)
+	delete(ms.joinRequests, uuid)
+	delete(ms.groupBans, uuid)
+	return nil
+}
+
+func (ms *MemoryStore) GetGroup(_ context.Context, uuid Uuid) (*Group, error) {
+	ms.mu.Lock()
+	groupJSON, exists := ms.groups[uuid]
+	ms.mu.Unlock()
+	if !exists {
+		return nil, nil
+	}
+	var group Group
+	if err := json.Unmarshal(groupJSON, &group); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal group: %v", err)
+	}
+	return &group, nil
+}
+
+func (ms *MemoryStore) GetGroups(_ context.Context) ([]Group, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if len(ms.groups) == 0 {
+		return nil, nil
+	}
+	out := make([]Group, 0, len(ms.groups))
+	for _, groupJSON := range ms.groups {
+		var group Group
+		if err := json.Unmarshal(groupJSON, &group); err != nil {
+			return nil, err
+		}
+		out = append(out, group)
+	}
+	return out, nil
+}
+
+func (ms *MemoryStore) AddUserToGroup(_ context.Context, user, group Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	addToSet(ms.groupUsers, group, user)
+	addToSet(ms.userGroups, user, group)
+	return nil
+}
+
+func (ms *MemoryStore) DeleteUserFromGroup(_ context.Context, user, group Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.groupUsers[group], user)
+	return nil
+}
+
+func (ms *MemoryStore) UserIsMemberOfGroup(_ context.Context, user, group Uuid) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, exists := ms.groupUsers[group][user]
+	return exists, nil
+}
+
+func (ms *MemoryStore) UsersInGroup(_ context.Context, group Uuid) ([]Uuid, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return setMembers(ms.groupUsers[group]), nil
+}
+
+func (ms *MemoryStore) GroupsForUser(_ context.Context, user Uuid) ([]Uuid, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return setMembers(ms.userGroups[user]), nil
+}
+
+func (ms *MemoryStore) BanFromGroup(_ context.Context, group, user Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	addToSet(ms.groupBans, group, user)
+	addToSet(ms.userGroups, user, group)
+	return nil
+}
+
+func (ms *MemoryStore) UnbanFromGroup(_ context.Context, group, user Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.groupBans[group], user)
+	return nil
+}
+
+func (ms *MemoryStore) IsBannedFromGroup(_ context.Context, group, user Uuid) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, banned := ms.groupBans[group][user]
+	return banned, nil
+}
+
+func (ms *MemoryStore) BannedFromGroup(_ context.Context, group Uuid) ([]Uuid, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return setMembers(ms.groupBans[group]), nil
+}
+
+func (ms *MemoryStore) AddJoinRequest(_ context.Context, group, user Uuid, sentAt int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.joinRequests[group] == nil {
+		ms.joinRequests[group] = map[Uuid]int64{}
+	}
+	ms.joinRequests[group][user] = sentAt
+	addToSet(ms.userGroups, user, group)
+	return nil
+}
+
+func (ms *MemoryStore) DeleteJoinRequest(_ context.Context, group, user Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.joinRequests[group], user)
+	return nil
+}
+
+func (ms *MemoryStore) HasJoinRequest(_ context.Context, group, user Uuid) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, exists := ms.joinRequests[group][user]
+	return exists, nil
+}
+
+func (ms *MemoryStore) JoinRequests(_ context.Context, group Uuid) ([]Uuid, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return sortedSetMembers(ms.joinRequests[group]), nil
+}
+
+func (ms *MemoryStore) AddGroupInvite(_ context.Context, invite *GroupInvite) error {
+	inviteJSON, err := json.Marshal(invite)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.groupInvites[invite.Code] = expiringEntry{
+		value:     inviteJSON,
+		expiresAt: time.Unix(invite.ValidUntil, 0),
+	}
+	if ms.groupInviteCodes[invite.Group] == nil {
+		ms.groupInviteCodes[invite.Group] = map[string]struct{}{}
+	}
+	ms.groupInviteCodes[invite.Group][invite.Code] = struct{}{}
+	return nil
+}
+
+// Returns the invite with code, or nil if it does not exist or has expired. mu must be held.
+func (ms *MemoryStore) groupInvite(code string) (*GroupInvite, error) {
+	entry, exists := ms.groupInvites[code]
+	if !exists {
+		return nil, nil
+	} else if entry.expiresAt.Before(time.Now()) {
+		delete(ms.groupInvites, code)
+		return nil, nil
+	}
+	var invite GroupInvite
+	if err := json.Unmarshal(entry.value, &invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (ms *MemoryStore) GetGroupInvite(_ context.Context, code string) (*GroupInvite, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.groupInvite(code)
+}
+
+func (ms *MemoryStore) DeleteGroupInvite(_ context.Context, group Uuid, code string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.groupInvites, code)
+	delete(ms.groupInviteCodes[group], code)
+	return nil
+}
+
+func (ms *MemoryStore) GroupInvites(_ context.Context, group Uuid) ([]GroupInvite, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	codes := make([]string, 0, len(ms.groupInviteCodes[group]))
+	for code := range ms.groupInviteCodes[group] {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	var out []GroupInvite
+	for _, code := range codes {
+		invite, err := ms.groupInvite(code)
+		if err != nil {
+			return nil, err
+		} else if invite == nil {
+			delete(ms.groupInviteCodes[group], code)
+			continue
+		}
+		out = append(out, *invite)
+	}
+	return out, nil
+}
+
+func (ms *MemoryStore) AddMessage(_ context.Context, msg *Message) error {
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	entry := expiringEntry{value: msgJSON}
+	// Like redis, messages without a TTL never expire.
+	if msg.TTL > 0 {
+		entry.expiresAt = time.Now().Add(time.Second * time.Duration(msg.TTL))
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.messages[msg.Uuid] = entry
+	return nil
+}
+
+// Returns the message if it exists and has not expired. mu must be held.
+func (ms *MemoryStore) getMessage(uuid Uuid, now time.Time) (*Message, error) {
+	entry, exists := ms.messages[uuid]
+	if !exists {
+		return nil, nil
+	} else if !entry.expiresAt.IsZero() && entry.expiresAt.Before(now) {
+		delete(ms.messages, uuid)
+		return nil, nil
+	}
+	var msg Message
+	if err := json.Unmarshal(entry.value, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (ms *MemoryStore) GetMessage(_ context.Context, uuid Uuid) (*Message, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.getMessage(uuid, time.Now())
+}
+
+func (ms *MemoryStore) DeleteMessage(_ context.Context, uuid Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.messages, uuid)
+	return nil
+}
+
+func (ms *MemoryStore) AddToInbox(_ context.Context, recipient Uuid, msg *Message) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.inboxes[recipient] == nil {
+		ms.inboxes[recipient] = map[Uuid]int64{}
+	}
+	ms.inboxes[recipient][msg.Uuid] = msg.SentAt
+	return nil
+}
+
+func (ms *MemoryStore) RemoveFromInbox(_ context.Context, recipient, msg Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.inboxes[recipient], msg)
+	return nil
+}
+
+func (ms *MemoryStore) ClearInbox(_ context.Context, recipient Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.inboxes, recipient)
+	return nil
+}
+
+func (ms *MemoryStore) InboxMessages(_ context.Context, recipient Uuid) ([]*Message, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	var out []*Message
+	for _, uuid := range sortedSetMembers(ms.inboxes[recipient]) {
+		msg, err := ms.getMessage(uuid, now)
+		if err != nil {
+			return nil, err
+		} else if msg == nil || msg.Expired(now) {
+			delete(ms.inboxes[recipient], uuid)
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+func (ms *MemoryStore) AddReply(_ context.Context, reply *MessageReply) error {
+	expiresAt := reply.Message.ExpiresAt()
+	if !expiresAt.After(time.Now()) {
+		return fmt.Errorf("Message being replied to has expired")
+	}
+	replyJSON, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.replies[reply.Uuid] = expiringEntry{value: replyJSON, expiresAt: expiresAt}
+	return nil
+}
+
+// Returns the reply if it exists and has not expired. mu must be held.
+func (ms *MemoryStore) getReply(uuid Uuid, now time.Time) (*MessageReply, error) {
+	entry, exists := ms.replies[uuid]
+	if !exists {
+		return nil, nil
+	} else if entry.expiresAt.Before(now) {
+		delete(ms.replies, uuid)
+		return nil, nil
+	}
+	var reply MessageReply
+	if err := json.Unmarshal(entry.value, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (ms *MemoryStore) GetReply(_ context.Context, uuid Uuid) (*MessageReply, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.getReply(uuid, time.Now())
+}
+
+func (ms *MemoryStore) AddReplyForUser(_ context.Context, user Uuid, reply *MessageReply) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.replyQueues[user] == nil {
+		ms.replyQueues[user] = map[Uuid]int64{}
+	}
+	ms.replyQueues[user][reply.Uuid] = reply.SentAt
+	return nil
+}
+
+func (ms *MemoryStore) ClearRepliesForUser(_ context.Context, user Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.replyQueues, user)
+	return nil
+}
+
+func (ms *MemoryStore) ListRepliesForUser(_ context.Context, user Uuid) ([]*MessageReply, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	var out []*MessageReply
+	for _, uuid := range sortedSetMembers(ms.replyQueues[user]) {
+		reply, err := ms.getReply(uuid, now)
+		if err != nil {
+			return nil, err
+		} else if reply == nil || (reply.Message != nil && reply.Message.Expired(now)) {
+			delete(ms.replyQueues[user], uuid)
+			continue
+		}
+		out = append(out, reply)
+	}
+	return out, nil
+}
+
+func (ms *MemoryStore) AddReport(_ context.Context, report *Report) error {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.reports[report.Uuid] = reportJSON
+	return nil
+}
+
+func (ms *MemoryStore) ListReports(_ context.Context) ([]Report, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	out := make([]Report, 0, len(ms.reports))
+	for _, reportJSON := range ms.reports {
+		var report Report
+		if err := json.Unmarshal(reportJSON, &report); err != nil {
+			return nil, err
+		}
+		out = append(out, report)
+	}
+	sortReports(out)
+	return out, nil
+}
+
+func (ms *MemoryStore) DeleteReport(_ context.Context, uuid Uuid) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.reports, uuid)
+	return nil
+}
+
+func (ms *MemoryStore) IncrEmojiSent(_ context.Context, e EmojiContent) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.emojisSent[e] += 1
+	return nil
+}
+
+func (ms *MemoryStore) EmojiSentAt(_ context.Context, e EmojiContent) (float64, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	t, exists := ms.emojiSentAt[e]
+	return t, exists, nil
+}
+
+func (ms *MemoryStore) SetEmojiSentAt(_ context.Context, e EmojiContent, localTime float64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.emojiSentAt[e] = localTime
+	return nil
+}
+
+func (ms *MemoryStore) RandomEmojiSentAt(_ context.Context, n int) (map[EmojiContent]float64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	out := make(map[EmojiContent]float64, n)
+	// Map iteration order is already random.
+	for e, t := range ms.emojiSentAt {
+		if len(out) == n {
+			break
+		}
+		out[e] = t
+	}
+	return out, nil
+}
+
+func (ms *MemoryStore) IncrReply(_ context.Context, original EmojiContent, reply EmojiReply) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.replyCounts[reply] += 1
+	if ms.emojiReplies[original] == nil {
+		ms.emojiReplies[original] = map[EmojiReply]int{}
+	}
+	ms.emojiReplies[original][reply] += 1
+	return nil
+}
+
+func (ms *MemoryStore) Summary(_ context.Context) (*SummaryResponse, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	out := SummaryResponse{
+		Counts:         make(map[string]int, len(ms.emojisSent)),
+		Times:          make(map[string]float64, len(ms.emojiSentAt)),
+		ReplyCounts:    make(map[string]int, len(ms.replyCounts)),
+		MessageReplies: make(map[string]map[string]int, len(ms.emojiReplies)),
+	}
+	for e, count := range ms.emojisSent {
+		out.Counts[string(e)] = count
+	}
+	for e, t := range ms.emojiSentAt {
+		out.Times[string(e)] = t
+	}
+	for r, count := range ms.replyCounts {
+		out.ReplyCounts[string(r)] = count
+	}
+	for e, replies := range ms.emojiReplies {
+		replyCounts := make(map[string]int, len(replies))
+		for r, count := range replies {
+			replyCounts[string(r)] = count
+		}
+		out.MessageReplies[string(e)] = replyCounts
+	}
+	return &out, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Longest reason which can be given for a report.
+const maxReportReasonLength = 500
+
+var errSuspended = errors.New("Account is suspended")
+
+var errNoReportTarget = errors.New("What was reported does not exist")
+
+// Adds a report from reporter to the moderation queue, recording what was reported as it is now.
+func (s *Server) report(
+	ctx context.Context, reporter Uuid, kind ReportKind, target Uuid, reason string,
+) (*Report, error) {
+	uuid, err := generateUuid()
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{
+		Uuid:      uuid,
+		Reporter:  reporter,
+		Kind:      kind,
+		Target:    target,
+		Reason:    reason,
+		CreatedAt: time.Now().Unix(),
+	}
+	switch kind {
+	case ReportMessage:
+		msg, err := s.GetMessage(ctx, target)
+		if err != nil {
+			return nil, err
+		} else if msg == nil {
+			return nil, errNoReportTarget
+		}
+		report.Content = string(msg.Emojis)
+		report.Offender = msg.Source.Uuid
+	case ReportUser:
+		user, err := s.GetUser(ctx, target)
+		if err != nil {
+			return nil, err
+		} else if user == nil {
+			return nil, errNoReportTarget
+		}
+		report.Content = user.Name
+		report.Offender = user.Uuid
+	case ReportGroup:
+		group, err := s.GetGroup(ctx, target)
+		if err != nil {
+			return nil, err
+		} else if group == nil {
+			return nil, errNoReportTarget
+		}
+		report.Content = group.Name
+	default:
+		return nil, fmt.Errorf("Unknown report kind %v", kind)
+	}
+	return report, s.AddReport(ctx, report)
+}
+
+// Sorts reports from oldest to newest.
+func sortReports(reports []Report) {
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].CreatedAt != reports[j].CreatedAt {
+			return reports[i].CreatedAt < reports[j].CreatedAt
+		}
+		return reports[i].Uuid < reports[j].Uuid
+	})
+}
+
+// Suspends or reinstates a user. Suspending a user also logs them out everywhere.
+func (s *Server) setSuspended(ctx context.Context, user Uuid, suspended bool) error {
+	_, err := s.updateUser(ctx, user, func(user *User) error {
+		user.Suspended = suspended
+		return nil
+	})
+	if err != nil || !suspended {
+		return err
+	}
+	return s.revokeAllSessions(ctx, user)
+}
+
+// Deletes a group along with its membership, regardless of who is in it.
+func (s *Server) deleteGroupAsAdmin(ctx context.Context, groupUuid Uuid) (bool, error) {
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil || group == nil {
+		return false, err
+	}
+	return true, s.DeleteGroup(ctx, groupUuid)
+}
+
+// admin wraps a handler so that it is only called for requests which have the AdminToken as their
+// bearer token.
+func (s *Server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken == "" {
+			w.WriteHeader(404)
+			fmt.Fprint(w, "Admin API is disabled")
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			w.WriteHeader(401)
+			fmt.Fprint(w, "Invalid admin token")
+			return
+		}
+		h(w, r)
+	}
+}
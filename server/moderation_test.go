@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestModeration(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		s.AdminToken = "admin secret"
+		clients := newTestClients(t, ts, 2)
+		alice, bob := clients[0], clients[1]
+		ctx := context.Background()
+		group := Group{Uuid: Uuid(1), Name: "trolls", Users: map[Uuid]string{alice.UserID(): "user0"}}
+		if err := s.AddGroup(ctx, &group); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddUserToGroup(ctx, alice.UserID(), group.Uuid); err != nil {
+			t.Fatal(err)
+		}
+
+		msg := Message{Emojis: "🤬🤬🤬", SentAt: time.Now().Unix(), TTL: 60, LocalTime: 12}
+		if err := alice.SendMsg(bob.UserID(), MsgFriend, msg); err != nil {
+			t.Fatal(err)
+		}
+		recv, err := bob.RecvMsg(false)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(recv.NewMessages) != 1 {
+			t.Fatalf("Got %d messages, want 1", len(recv.NewMessages))
+		}
+		if err = bob.Report(ReportMessage, recv.NewMessages[0].Uuid, "rude"); err != nil {
+			t.Fatal(err)
+		}
+		if err = bob.Report(ReportUser, alice.UserID(), ""); err != nil {
+			t.Fatal(err)
+		}
+		if err = bob.Report(ReportGroup, group.Uuid, "offensive name"); err != nil {
+			t.Fatal(err)
+		}
+		if err = bob.Report(ReportUser, Uuid(42), ""); err == nil {
+			t.Error("Reported a user who does not exist")
+		}
+
+		admin := &mojiClient{httpc: http.DefaultClient, dst: ts.URL, sessionToken: s.AdminToken}
+		impostor := &mojiClient{httpc: http.DefaultClient, dst: ts.URL, sessionToken: "guess"}
+		if _, err = impostor.AdminOp(ListReportsOp, InvalidUuid); err == nil {
+			t.Error("Listed reports without the admin token")
+		}
+		if _, err = bob.AdminOp(ListReportsOp, InvalidUuid); err == nil {
+			t.Error("Listed reports with a session token")
+		}
+		resp, err := admin.AdminOp(ListReportsOp, InvalidUuid)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(resp.Reports) != 3 {
+			t.Fatalf("Got %d reports, want 3", len(resp.Reports))
+		}
+		for _, got := range resp.Reports {
+			if got.Kind == ReportMessage && (got.Content != "🤬🤬🤬" ||
+				got.Offender != alice.UserID() || got.Reporter != bob.UserID() || got.Reason != "rude") {
+				t.Errorf("Unexpected message report %+v", got)
+			}
+		}
+
+		if _, err = admin.AdminOp(SuspendUser, alice.UserID()); err != nil {
+			t.Fatal(err)
+		}
+		// Suspending does not depend on the sessions of the user having been revoked.
+		suspended, err := s.GetUser(ctx, bob.UserID())
+		if err != nil || suspended == nil {
+			t.Fatalf("Failed to get user: %v", err)
+		}
+		suspended.Suspended = true
+		if err = s.AddUser(ctx, suspended); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = bob.RecvMsg(false); err == nil {
+			t.Error("Session token of a suspended user is still valid")
+		}
+		sessionToken := bob.sessionToken
+		bob.sessionToken = ""
+		if _, err = bob.RecvMsg(false); err == nil {
+			t.Error("Login token of a suspended user is still valid")
+		}
+		bob.sessionToken = sessionToken
+		suspended.Suspended = false
+		if err = s.AddUser(ctx, suspended); err != nil {
+			t.Fatal(err)
+		}
+		if err = alice.SendMsg(bob.UserID(), MsgFriend, msg); err == nil {
+			t.Error("Suspended user sent a message")
+		}
+		if err = alice.Login("user0@example.com"); err == nil {
+			t.Error("Suspended user logged in")
+		}
+		if _, err = admin.AdminOp(UnsuspendUser, alice.UserID()); err != nil {
+			t.Fatal(err)
+		}
+		if err = alice.Login("user0@example.com"); err != nil {
+			t.Errorf("Could not log in after being unsuspended: %v", err)
+		}
+
+		if _, err = admin.AdminOp(DeleteGroupAsAdmin, group.Uuid); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.GetGroup(ctx, group.Uuid); err != nil || got != nil {
+			t.Errorf("Group still exists after being deleted: %v, %v", got, err)
+		}
+		if _, err = admin.AdminOp(DeleteGroupAsAdmin, group.Uuid); err == nil {
+			t.Error("Deleted a group which does not exist")
+		}
+
+		if _, err = admin.AdminOp(DismissReport, resp.Reports[0].Uuid); err != nil {
+			t.Fatal(err)
+		}
+		if resp, err = admin.AdminOp(ListReportsOp, InvalidUuid); err != nil {
+			t.Fatal(err)
+		} else if len(resp.Reports) != 2 {
+			t.Errorf("Got %d reports after dismissing one, want 2", len(resp.Reports))
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cost used when hashing passwords, only lowered in tests.
+var passwordHashCost = bcrypt.DefaultCost
+
+// Derives a salted slow hash of the password sent by a client, which is what gets stored.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Passwords stored before the server hashed them are whatever the client sent verbatim.
+func isLegacyPasswordHash(stored string) bool {
+	return !strings.HasPrefix(stored, "$2")
+}
+
+// Checks whether password matches what is stored for a user. Legacy values are compared in
+// constant time, and should be replaced with hashPassword once they match.
+func checkPassword(stored, password string) bool {
+	if stored == "" || password == "" {
+		return false
+	}
+	if isLegacyPasswordHash(stored) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+}
+
+// How long a password reset code can be used for.
+const passwordResetDuration = time.Hour
+
+// Emails a one time code to the user with email which allows them to set a new password. Nothing
+// happens if no user has that email, so that it is not revealed who has signed up.
+func (s *Server) RequestPasswordReset(ctx context.Context, email Email) error {
+	// Refuse whether or not the user exists, so that this does not reveal it either.
+	if _, ok := s.Mailer.(noMailer); ok {
+		return errNoMailer
+	}
+	user, err := s.UserByEmail(ctx, email)
+	if err != nil || user == nil {
+		return err
+	}
+	code, err := s.issueEmailCode(ctx, PasswordResetCode, user.Uuid, passwordResetDuration)
+	if err == errEmailCodeCooldown {
+		// The code sent recently can still be used, and erroring would reveal the user exists.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(
+		"Your code to reset your 3moji password is %s. It expires in %v.\n\n"+
+			"If you did not ask to reset your password, you can ignore this email.",
+		code, passwordResetDuration,
+	)
+	return s.Mailer.SendMail(user.Email, "Reset your 3moji password", body)
+}
+
+// Sets a new password for the user with email if code is the one which was emailed to them. The
+// code can only be used once, and every existing session of the user is logged out.
+func (s *Server) ConfirmPasswordReset(ctx context.Context, email Email, code, hashedPassword string) error {
+	if hashedPassword == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+	user, err := s.UserByEmail(ctx, email)
+	if err != nil {
+		return err
+	} else if user == nil {
+		return errInvalidEmailCode
+	}
+
+	if err = s.useEmailCode(ctx, PasswordResetCode, user.Uuid, code); err != nil {
+		return err
+	}
+	passwordHash, err := hashPassword(hashedPassword)
+	if err != nil {
+		return err
+	}
+	if err = s.SetPasswordHash(ctx, user.Uuid, passwordHash); err != nil {
+		return err
+	}
+	return s.revokeAllSessions(ctx, user.Uuid)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	// Keep tests which sign up many users fast.
+	passwordHashCost = bcrypt.MinCost
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isLegacyPasswordHash(hash) {
+		t.Errorf("%q should not be a legacy hash", hash)
+	}
+	if !checkPassword(hash, "hunter2") {
+		t.Error("Correct password was rejected")
+	}
+	if checkPassword(hash, "hunter3") {
+		t.Error("Incorrect password was accepted")
+	}
+	if !checkPassword("legacy", "legacy") || checkPassword("legacy", "legacy2") {
+		t.Error("Legacy passwords should be compared directly")
+	}
+	if checkPassword("", "") {
+		t.Error("Empty password was accepted")
+	}
+}
+
+func TestLoginUpgradesLegacyPassword(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s := &Server{Store: store}
+		ctx := context.Background()
+		user := &User{Uuid: Uuid(1), Name: "legacy", Email: "legacy@example.com"}
+		if err := store.CreateUser(ctx, user, "client-hash"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Login(ctx, user.Email, "client-hash", ""); err != nil {
+			t.Fatalf("Failed to log in with legacy password: %v", err)
+		}
+		stored, err := store.PasswordHash(ctx, user.Uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLegacyPasswordHash(stored) {
+			t.Errorf("Password was not upgraded after login, still %q", stored)
+		}
+		if _, err := s.Login(ctx, user.Email, "client-hash", ""); err != nil {
+			t.Errorf("Failed to log in after upgrading password: %v", err)
+		}
+		if _, err := s.Login(ctx, user.Email, "wrong", ""); err == nil {
+			t.Error("Logged in with wrong password")
+		}
+	})
+}
+
+var resetCodePattern = regexp.MustCompile(`\b\d{8}\b`)
+
+func TestPasswordReset(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		var mail bytes.Buffer
+		s.Mailer = &LogMailer{W: &mail}
+		c := newTestClients(t, ts, 1)[0]
+		email := string(c.user.Email)
+		// Forget the verification email sent on signing up.
+		mail.Reset()
+		ctx := context.Background()
+
+		// Unknown emails are accepted without sending anything.
+		if err := c.ResetPassword("nobody@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if mail.Len() != 0 {
+			t.Fatalf("Sent mail for an unknown email:\n%s", mail.String())
+		}
+
+		if err := c.ResetPassword(email); err != nil {
+			t.Fatal(err)
+		}
+		code := resetCodePattern.FindString(mail.String())
+		if code == "" || !strings.Contains(mail.String(), "To: "+email) {
+			t.Fatalf("Did not mail a reset code:\n%s", mail.String())
+		}
+		// Asking again right away does not send another code or replace the first.
+		mail.Reset()
+		if err := c.ResetPassword(email); err != nil {
+			t.Fatal(err)
+		} else if mail.Len() != 0 {
+			t.Fatalf("Sent another code during the cooldown:\n%s", mail.String())
+		}
+		wrong := "00000000"
+		if code == wrong {
+			wrong = "11111111"
+		}
+		if err := c.ConfirmResetPassword(email, wrong, "new"); err == nil {
+			t.Error("Reset password with the wrong code")
+		}
+		if err := c.ConfirmResetPassword(email, code, "new"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.RecvMsg(false); err == nil {
+			t.Error("Session is still valid after resetting password")
+		}
+		if _, err := s.Login(ctx, c.user.Email, "test", ""); err == nil {
+			t.Error("Logged in with the old password")
+		}
+		if _, err := s.Login(ctx, c.user.Email, "new", ""); err != nil {
+			t.Errorf("Failed to log in with the new password: %v", err)
+		}
+		if err := c.ConfirmResetPassword(email, code, "newer"); err == nil {
+			t.Error("Reset code was used twice")
+		}
+	})
+}
+
+func TestPasswordResetWithoutMailer(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		s.Mailer = noMailer{}
+		c := newTestClients(t, ts, 1)[0]
+
+		for _, email := range []string{string(c.user.Email), "nobody@example.com"} {
+			if err := c.ResetPassword(email); err == nil {
+				t.Errorf("Accepted resetting the password of %s without a mailer", email)
+			}
+		}
+	})
+}
+
+func TestPasswordResetAttempts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		var mail bytes.Buffer
+		s.Mailer = &LogMailer{W: &mail}
+		c := newTestClients(t, ts, 1)[0]
+		email := string(c.user.Email)
+		// Forget the verification email sent on signing up.
+		mail.Reset()
+
+		if err := c.ResetPassword(email); err != nil {
+			t.Fatal(err)
+		}
+		code := resetCodePattern.FindString(mail.String())
+		for i := 0; i < maxEmailCodeAttempts; i++ {
+			wrong := fmt.Sprintf("%08d", i)
+			if wrong == code {
+				wrong = "99999999"
+			}
+			if err := c.ConfirmResetPassword(email, wrong, "new"); err == nil {
+				t.Fatal("Reset password with the wrong code")
+			}
+		}
+		if err := c.ConfirmResetPassword(email, code, "new"); err == nil {
+			t.Error("Reset code still works after too many wrong attempts")
+		}
+	})
+}
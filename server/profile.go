@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+	// Time zones of users must be known even where the system has no zoneinfo.
+	_ "time/tzdata"
+	"unicode/utf8"
+)
+
+// Longest name a user can have.
+const maxNameLength = 64
+
+// Longest default TTL a user can pick, which is a week.
+const maxDefaultTTL = 7 * 24 * 60 * 60
+
+// Applies the changes in req to the profile of user. A new name is also updated in every group
+// the user is in.
+func (s *Server) UpdateProfile(ctx context.Context, user Uuid, req *UpdateProfileRequest) (*User, error) {
+	if req.Name != nil {
+		if n := utf8.RuneCountInString(*req.Name); n == 0 || n > maxNameLength {
+			return nil, fmt.Errorf("Name must be between 1 and %d characters", maxNameLength)
+		}
+	}
+	if req.DefaultTTL != nil && (*req.DefaultTTL < 0 || *req.DefaultTTL > maxDefaultTTL) {
+		return nil, fmt.Errorf("Default TTL must be between 0 and %d seconds", maxDefaultTTL)
+	}
+	if req.TimeZone != nil {
+		if _, err := time.LoadLocation(*req.TimeZone); err != nil {
+			return nil, fmt.Errorf("Unknown time zone %q", *req.TimeZone)
+		}
+	}
+	if req.DirectMessages != nil && !req.DirectMessages.IsValid() {
+		return nil, fmt.Errorf("Unknown direct message policy %v", *req.DirectMessages)
+	}
+	for _, hour := range []*int{req.QuietHoursStart, req.QuietHoursEnd} {
+		if hour != nil && (*hour < 0 || *hour > 23) {
+			return nil, fmt.Errorf("Quiet hours must be between 0 and 23")
+		}
+	}
+
+	renamed := false
+	updated, err := s.updateUser(ctx, user, func(user *User) error {
+		if req.Name != nil && *req.Name != user.Name {
+			user.Name = *req.Name
+			renamed = true
+		}
+		if req.DefaultTTL != nil {
+			user.DefaultTTL = *req.DefaultTTL
+		}
+		if req.TimeZone != nil {
+			user.TimeZone = *req.TimeZone
+		}
+		if req.QuietHoursStart != nil {
+			user.QuietHoursStart = *req.QuietHoursStart
+		}
+		if req.QuietHoursEnd != nil {
+			user.QuietHoursEnd = *req.QuietHoursEnd
+		}
+		if req.Undiscoverable != nil {
+			user.Undiscoverable = *req.Undiscoverable
+		}
+		if req.DirectMessages != nil {
+			user.DirectMessages = *req.DirectMessages
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if renamed {
+		if err = s.renameInGroups(ctx, updated); err != nil {
+			return nil, err
+		}
+	}
+	return updated, nil
+}
+
+// Updates the name kept for user in each group they are in.
+func (s *Server) renameInGroups(ctx context.Context, user *User) error {
+	groups, err := s.GroupsForUser(ctx, user.Uuid)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if err = s.renameInGroup(ctx, user, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) renameInGroup(ctx context.Context, user *User, groupUuid Uuid) error {
+	defer s.groupLocks.Lock(groupUuid)()
+	group, err := s.GetGroup(ctx, groupUuid)
+	if err != nil || group == nil {
+		return err
+	}
+	if _, member := group.Users[user.Uuid]; !member {
+		return nil
+	}
+	group.Users[user.Uuid] = user.Name
+	return s.AddGroup(ctx, group)
+}
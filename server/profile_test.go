@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUpdateProfile(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 2)
+		alice, bob := clients[0], clients[1]
+		ctx := context.Background()
+		group := Group{Uuid: Uuid(1), Name: "renamers", Users: map[Uuid]string{}}
+		group.Users[alice.UserID()] = alice.user.Name
+		group.Users[bob.UserID()] = bob.user.Name
+		if err := s.AddGroup(ctx, &group); err != nil {
+			t.Fatal(err)
+		}
+		for uuid := range group.Users {
+			if err := s.AddUserToGroup(ctx, uuid, group.Uuid); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		name, ttl, tz := "Alice", int64(120), "America/New_York"
+		start, end := 22, 7
+		user, err := alice.UpdateProfile(UpdateProfileRequest{
+			Name: &name, DefaultTTL: &ttl, TimeZone: &tz,
+			QuietHoursStart: &start, QuietHoursEnd: &end,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Name != name || user.DefaultTTL != ttl || user.TimeZone != tz ||
+			user.QuietHoursStart != start || user.QuietHoursEnd != end {
+			t.Errorf("Profile was not updated, got %+v", user)
+		}
+		if stored, _ := store.UserByEmail(ctx, alice.user.Email); stored == nil || *stored != user {
+			t.Errorf("User found by email is %+v, want %+v", stored, user)
+		}
+		got, err := store.GetGroup(ctx, group.Uuid)
+		if err != nil || got.Users[alice.UserID()] != name {
+			t.Errorf("Name was not updated in group, got %v: %v", got, err)
+		}
+		if got.Users[bob.UserID()] != bob.user.Name {
+			t.Errorf("Other members were changed, got %v", got)
+		}
+
+		// Fields which are not sent are left alone.
+		if user, err = alice.UpdateProfile(UpdateProfileRequest{}); err != nil || user.DefaultTTL != ttl {
+			t.Errorf("Empty update changed profile to %+v: %v", user, err)
+		}
+
+		// Messages without a TTL use the default.
+		msg := Message{Emojis: "🍕🍔🌯", SentAt: time.Now().Unix(), LocalTime: 12}
+		if err = alice.SendMsg(bob.UserID(), MsgFriend, msg); err != nil {
+			t.Fatal(err)
+		}
+		recv, err := bob.RecvMsg(false)
+		if err != nil || len(recv.NewMessages) != 1 || recv.NewMessages[0].TTL != ttl {
+			t.Errorf("Got %v, want a message with the default TTL: %v", recv, err)
+		}
+
+		bad := "Not/AZone"
+		if _, err = alice.UpdateProfile(UpdateProfileRequest{TimeZone: &bad}); err == nil {
+			t.Error("Set an unknown time zone")
+		}
+		empty := ""
+		if _, err = alice.UpdateProfile(UpdateProfileRequest{Name: &empty}); err == nil {
+			t.Error("Set an empty name")
+		}
+	})
+}
+
+func TestUndiscoverable(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		_, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 3)
+		hidden := true
+		if _, err := clients[0].UpdateProfile(UpdateProfileRequest{Undiscoverable: &hidden}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddFriend(context.Background(), clients[1].UserID(), clients[0].UserID()); err != nil {
+			t.Fatal(err)
+		}
+		if people, err := clients[2].ListPeople(All); err != nil || len(people) != 1 {
+			t.Errorf("Got %v, want only the discoverable user: %v", people, err)
+		}
+		if people, err := clients[1].ListPeople(All); err != nil || len(people) != 2 {
+			t.Errorf("Got %v, want friends to still see the user: %v", people, err)
+		}
+	})
+}
+
+func TestQuietHours(t *testing.T) {
+	user := User{QuietHoursStart: 22, QuietHoursEnd: 7, TimeZone: "America/New_York"}
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hour, want := range map[int]bool{21: false, 22: true, 23: true, 0: true, 6: true, 7: false, 12: false} {
+		at := time.Date(2021, 6, 1, hour, 30, 0, 0, loc)
+		if got := user.InQuietHours(at); got != want {
+			t.Errorf("InQuietHours at %v = %v, want %v", at, got, want)
+		}
+	}
+	if (&User{}).InQuietHours(time.Now()) {
+		t.Error("Users without quiet hours are always in them")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	expo "github.com/oliveroneill/exponent-server-sdk-golang/sdk"
+)
+
+// Returns the push tokens of users who can be sent a notification from the user from now,
+// skipping those without one, in their quiet hours, or blocked by or blocking from. from may be
+// InvalidUuid if the notification is not from anyone.
+func (s *Server) notifTokensFor(ctx context.Context, from Uuid, uuids []Uuid) []expo.ExponentPushToken {
+	blocked := map[Uuid]struct{}{}
+	if from.IsValid() {
+		var err error
+		if blocked, err = s.blockSet(ctx, from); err != nil {
+			fmt.Printf("Failed to get blocked users: %v", err)
+			return nil
+		}
+	}
+	now := time.Now()
+	var to []expo.ExponentPushToken
+	for _, uuid := range uuids {
+		if _, isBlocked := blocked[uuid]; isBlocked {
+			continue
+		}
+		notifToken, err := s.NotifToken(ctx, uuid)
+		if err != nil {
+			fmt.Printf("Failed to get user notif token: %v", err)
+			continue
+		} else if notifToken == "" {
+			continue
+		}
+		user, err := s.GetUser(ctx, uuid)
+		if err != nil || user == nil || user.InQuietHours(now) {
+			continue
+		}
+		to = append(to, expo.ExponentPushToken(notifToken))
+	}
+	return to
+}
+
+// Sends a push notification to every token in to, logging if it fails.
+func sendPush(to []expo.ExponentPushToken, title, body string) {
+	if len(to) == 0 {
+		return
+	}
+	client := expo.NewPushClient(nil)
+	resp, err := client.Publish(&expo.PushMessage{
+		To:       to,
+		Body:     body,
+		Sound:    "default",
+		Title:    title,
+		Priority: expo.DefaultPriority,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if resp.ValidateResponse() != nil {
+		fmt.Println("Failed to send push notification")
+	}
+}
@@ -0,0 +1,1106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStore is a Store which keeps everything in redis.
+type RedisStore struct {
+	// A long living redis client for using as a persistent store.
+	Client *redis.Client
+}
+
+// Connects to the redis instance at REDIS_URL, or a local one if it is not set.
+func NewRedisStore() *RedisStore {
+	redisURL := os.Getenv("REDIS_URL")
+	user := ""
+	password := ""
+	if redisURL == "" {
+		redisURL = ":6379"
+	} else {
+		u, err := url.Parse(redisURL)
+		if err != nil {
+			fmt.Println(err)
+		}
+		redisURL = u.Host
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     strings.TrimSuffix(redisURL, ":"),
+		Username: user,
+		// TODO need to set a password through secret.
+		Password: password,
+		DB:       0,
+	})
+	// ping the local redis database
+	if _, err := rdb.Ping(context.Background()).Result(); err != nil {
+		fmt.Printf("Failed to open ping redis: %v\n", err)
+	}
+	return &RedisStore{Client: rdb}
+}
+
+// Creates a user only if their email has not signed up yet, so that concurrent sign ups cannot
+// both succeed and a failure cannot leave a user half created. Returns 0 if the email exists.
+// Every key it touches is passed in KEYS, as Redis requires of scripts.
+var createUserScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+redis.call("HSET", KEYS[2], ARGV[2], ARGV[4])
+redis.call("HSET", KEYS[3], ARGV[2], ARGV[3])
+return 1
+`)
+
+func (rs *RedisStore) CreateUser(ctx context.Context, user *User, hashedPassword string) error {
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal user: %v", err)
+	}
+	keys := []string{"signed_up", "hashed_passwords", "users"}
+	created, err := createUserScript.Run(
+		ctx, rs.Client, keys, string(user.Email), user.Uuid.String(), userJSON, hashedPassword,
+	).Int()
+	if err != nil {
+		return fmt.Errorf("Error signing up: %v", err)
+	} else if created == 0 {
+		return ErrUserExists
+	}
+	return nil
+}
+
+func (rs *RedisStore) UserByEmail(ctx context.Context, email Email) (*User, error) {
+	userJSON, err := rs.Client.HGet(ctx, "signed_up", string(email)).Bytes()
+	if err == redis.Nil || (err == nil && len(userJSON) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var user User
+	if err = json.Unmarshal(userJSON, &user); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal user: %v", err)
+	}
+	return &user, nil
+}
+
+func (rs *RedisStore) PasswordHash(ctx context.Context, user Uuid) (string, error) {
+	hash, err := rs.Client.HGet(ctx, "hashed_passwords", user.String()).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return hash, err
+}
+
+func (rs *RedisStore) SetPasswordHash(ctx context.Context, user Uuid, hashedPassword string) error {
+	return rs.Client.HSet(ctx, "hashed_passwords", user.String(), hashedPassword).Err()
+}
+
+func (rs *RedisStore) AddUser(ctx context.Context, user *User) error {
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	// signed_up keeps a copy of each user as well, which must not go stale.
+	_, err = rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, "users", user.Uuid.String(), userJSON)
+		pipe.HSet(ctx, "signed_up", string(user.Email), userJSON)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) DeleteUser(ctx context.Context, user *User) error {
+	sessions, err := rs.uuidSet(ctx, UserSessionsRedisKey(user.Uuid))
+	if err != nil {
+		return err
+	}
+	keys := []string{
+		UserSessionsRedisKey(user.Uuid),
+		FriendsRedisKey(user.Uuid),
+		InboxRedisKey(user.Uuid),
+		RepliesRedisKey(user.Uuid),
+		IncomingFriendRequestsRedisKey(user.Uuid),
+		BlockedRedisKey(user.Uuid),
+		BlockedByRedisKey(user.Uuid),
+		OutgoingFriendRequestsRedisKey(user.Uuid),
+		UserGroupsRedisKey(user.Uuid),
+		SentByRedisKey(user.Uuid),
+		EmailCodeRedisKey(PasswordResetCode, user.Uuid),
+		EmailCodeRedisKey(VerifyEmailCode, user.Uuid),
+		fmt.Sprintf("%s_login_token", user.Email),
+	}
+	for _, session := range sessions {
+		keys = append(keys, SessionRedisKey(session))
+	}
+	_, err = rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, "users", user.Uuid.String())
+		pipe.HDel(ctx, "signed_up", string(user.Email))
+		pipe.HDel(ctx, "hashed_passwords", user.Uuid.String())
+		pipe.HDel(ctx, "user_notif_tokens", user.Uuid.String())
+		pipe.HDel(ctx, "tokens_valid_after", user.Uuid.String())
+		pipe.Del(ctx, keys...)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) AnonymizeUser(ctx context.Context, user Uuid, anon PublicUser) error {
+	keys, err := rs.Client.ZRange(ctx, SentByRedisKey(user), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	anonymizeMessage := func(value []byte) ([]byte, error) {
+		var msg Message
+		if err := json.Unmarshal(value, &msg); err != nil || msg.Source.Uuid != user {
+			return nil, err
+		}
+		msg.Source = anon
+		return json.Marshal(msg)
+	}
+	anonymizeReply := func(value []byte) ([]byte, error) {
+		var reply MessageReply
+		if err := json.Unmarshal(value, &reply); err != nil {
+			return nil, err
+		}
+		changed := false
+		if reply.From.Uuid == user {
+			reply.From = anon
+			changed = true
+		}
+		if reply.Message != nil && reply.Message.Source.Uuid == user {
+			reply.Message.Source = anon
+			changed = true
+		}
+		if !changed {
+			return nil, nil
+		}
+		return json.Marshal(reply)
+	}
+	for _, key := range keys {
+		rewrite := anonymizeMessage
+		if strings.HasPrefix(key, "reply_") {
+			rewrite = anonymizeReply
+		}
+		if err = rs.rewriteKey(ctx, key, rewrite); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the value of key with what rewrite returns for it, keeping its expiry. The value is
+// left unchanged if rewrite returns nil or the key does not exist.
+func (rs *RedisStore) rewriteKey(ctx context.Context, key string, rewrite func([]byte) ([]byte, error)) error {
+	value, err := rs.Client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	newValue, err := rewrite(value)
+	if err != nil || newValue == nil {
+		return err
+	}
+	err = rs.Client.SetXX(ctx, key, newValue, redis.KeepTTL).Err()
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
+// Sorted set of the keys of messages and replies which mention a user as their sender, scored
+// by when they expire, so that they can be anonymized without scanning every message.
+func SentByRedisKey(user Uuid) string {
+	return fmt.Sprintf("%s_sent", user)
+}
+
+// Adds key to the messages and replies sent by user, which expires at expiresAt or never if it
+// is zero. Keys which have expired are dropped, and the index expires along with its last key.
+func (rs *RedisStore) indexSentBy(ctx context.Context, user Uuid, key string, expiresAt time.Time) error {
+	indexKey := SentByRedisKey(user)
+	score := math.Inf(1)
+	if !expiresAt.IsZero() {
+		score = float64(expiresAt.Unix())
+	}
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, indexKey, &redis.Z{Score: score, Member: key})
+		pipe.ZRemRangeByScore(ctx, indexKey, "-inf", fmt.Sprintf("(%d", time.Now().Unix()))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	last, err := rs.Client.ZRevRangeWithScores(ctx, indexKey, 0, 0).Result()
+	if err != nil || len(last) == 0 {
+		return err
+	} else if math.IsInf(last[0].Score, 1) {
+		return rs.Client.Persist(ctx, indexKey).Err()
+	}
+	return rs.Client.ExpireAt(ctx, indexKey, time.Unix(int64(last[0].Score), 0)).Err()
+}
+
+func (rs *RedisStore) GetUser(ctx context.Context, uuid Uuid) (*User, error) {
+	userJSON, err := rs.Client.HGet(ctx, "users", uuid.String()).Bytes()
+	if err == redis.Nil || (err == nil && len(userJSON) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var user User
+	if err = json.Unmarshal(userJSON, &user); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal user: %v", err)
+	}
+	return &user, nil
+}
+
+func (rs *RedisStore) GetUsers(ctx context.Context) ([]User, error) {
+	userJSONs, err := rs.Client.HVals(ctx, "users").Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(userJSONs) == 0 {
+		return nil, nil
+	}
+	out := make([]User, len(userJSONs))
+	for i, userJSON := range userJSONs {
+		if err = json.Unmarshal([]byte(userJSON), &out[i]); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (rs *RedisStore) LegacyLoginToken(ctx context.Context, email Email) (*LoginToken, error) {
+	loginTokenKey := fmt.Sprintf("%s_login_token", email)
+	tokenJSON, err := rs.Client.Get(ctx, loginTokenKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var token LoginToken
+	if err = json.Unmarshal(tokenJSON, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func UserSessionsRedisKey(user Uuid) string {
+	return fmt.Sprintf("%s_sessions", user)
+}
+
+func (rs *RedisStore) DeleteLegacyLoginToken(ctx context.Context, email Email) error {
+	return rs.Client.Del(ctx, fmt.Sprintf("%s_login_token", email)).Err()
+}
+
+func (rs *RedisStore) SetTokensValidAfter(ctx context.Context, user Uuid, validAfter int64) error {
+	return rs.Client.HSet(ctx, "tokens_valid_after", user.String(), validAfter).Err()
+}
+
+func (rs *RedisStore) TokensValidAfter(ctx context.Context, user Uuid) (int64, error) {
+	validAfter, err := rs.Client.HGet(ctx, "tokens_valid_after", user.String()).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return validAfter, err
+}
+
+func (rs *RedisStore) AddSession(ctx context.Context, session *Session) error {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	duration := time.Until(time.Unix(session.ValidUntil, 0))
+	_, err = rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, SessionRedisKey(session.Uuid), sessionJSON, duration)
+		pipe.SAdd(ctx, UserSessionsRedisKey(session.User), session.Uuid.String())
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) GetSession(ctx context.Context, uuid Uuid) (*Session, error) {
+	sessionJSON, err := rs.Client.Get(ctx, SessionRedisKey(uuid)).Bytes()
+	if err == redis.Nil || (err == nil && len(sessionJSON) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var session Session
+	if err = json.Unmarshal(sessionJSON, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (rs *RedisStore) DeleteSession(ctx context.Context, user, uuid Uuid) error {
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, SessionRedisKey(uuid))
+		pipe.SRem(ctx, UserSessionsRedisKey(user), uuid.String())
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) SessionsForUser(ctx context.Context, user Uuid) ([]Session, error) {
+	uuids, err := rs.uuidSet(ctx, UserSessionsRedisKey(user))
+	if err != nil {
+		return nil, err
+	}
+	var out []Session
+	var expired []interface{}
+	for _, uuid := range uuids {
+		session, err := rs.GetSession(ctx, uuid)
+		if err != nil {
+			return nil, err
+		} else if session == nil || session.Expired() {
+			expired = append(expired, uuid.String())
+			continue
+		}
+		out = append(out, *session)
+	}
+	if len(expired) > 0 {
+		if err = rs.Client.SRem(ctx, UserSessionsRedisKey(user), expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (rs *RedisStore) DeleteSessionsForUser(ctx context.Context, user Uuid) error {
+	uuids, err := rs.uuidSet(ctx, UserSessionsRedisKey(user))
+	if err != nil {
+		return err
+	}
+	keys := []string{UserSessionsRedisKey(user)}
+	for _, uuid := range uuids {
+		keys = append(keys, SessionRedisKey(uuid))
+	}
+	return rs.Client.Del(ctx, keys...).Err()
+}
+
+func (rs *RedisStore) SetEmailCode(ctx context.Context, kind EmailCodeKind, code *EmailCode) error {
+	codeJSON, err := json.Marshal(code)
+	if err != nil {
+		return err
+	}
+	duration := time.Until(time.Unix(code.ValidUntil, 0))
+	return rs.Client.Set(ctx, EmailCodeRedisKey(kind, code.User), codeJSON, duration).Err()
+}
+
+func (rs *RedisStore) GetEmailCode(ctx context.Context, kind EmailCodeKind, user Uuid) (*EmailCode, error) {
+	codeJSON, err := rs.Client.Get(ctx, EmailCodeRedisKey(kind, user)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var code EmailCode
+	if err = json.Unmarshal(codeJSON, &code); err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+func (rs *RedisStore) DeleteEmailCode(ctx context.Context, kind EmailCodeKind, user Uuid) error {
+	return rs.Client.Del(ctx, EmailCodeRedisKey(kind, user)).Err()
+}
+
+func (rs *RedisStore) SetNotifToken(ctx context.Context, user Uuid, token string) error {
+	return rs.Client.HSet(ctx, "user_notif_tokens", user.String(), token).Err()
+}
+
+func (rs *RedisStore) NotifToken(ctx context.Context, user Uuid) (string, error) {
+	token, err := rs.Client.HGet(ctx, "user_notif_tokens", user.String()).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return token, err
+}
+
+func (rs *RedisStore) DeleteNotifToken(ctx context.Context, user Uuid) error {
+	return rs.Client.HDel(ctx, "user_notif_tokens", user.String()).Err()
+}
+
+// Set of the friends of a user.
+func FriendsRedisKey(user Uuid) string {
+	return fmt.Sprintf("%s_friends", user)
+}
+
+// Adds friend into the set of friends of user.
+func (rs *RedisStore) AddFriend(ctx context.Context, user, friend Uuid) error {
+	return rs.Client.SAdd(ctx, FriendsRedisKey(user), friend.String()).Err()
+}
+
+func (rs *RedisStore) RemoveFriend(ctx context.Context, user, friend Uuid) error {
+	return rs.Client.SRem(ctx, FriendsRedisKey(user), friend.String()).Err()
+}
+
+func (rs *RedisStore) IsFriend(ctx context.Context, user, friend Uuid) (bool, error) {
+	return rs.Client.SIsMember(ctx, FriendsRedisKey(user), friend.String()).Result()
+}
+
+// Finds the uuid of all friends of a user.
+func (rs *RedisStore) ListFriends(ctx context.Context, user Uuid) ([]Uuid, error) {
+	return rs.uuidSet(ctx, FriendsRedisKey(user))
+}
+
+func BlockedRedisKey(user Uuid) string {
+	return fmt.Sprintf("%s_blocked", user)
+}
+
+func BlockedByRedisKey(user Uuid) string {
+	return fmt.Sprintf("%s_blocked_by", user)
+}
+
+func (rs *RedisStore) Block(ctx context.Context, user, other Uuid) error {
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, BlockedRedisKey(user), other.String())
+		pipe.SAdd(ctx, BlockedByRedisKey(other), user.String())
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) Unblock(ctx context.Context, user, other Uuid) error {
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, BlockedRedisKey(user), other.String())
+		pipe.SRem(ctx, BlockedByRedisKey(other), user.String())
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) HasBlocked(ctx context.Context, user, other Uuid) (bool, error) {
+	return rs.Client.SIsMember(ctx, BlockedRedisKey(user), other.String()).Result()
+}
+
+func (rs *RedisStore) ListBlocked(ctx context.Context, user Uuid) ([]Uuid, error) {
+	return rs.uuidSet(ctx, BlockedRedisKey(user))
+}
+
+func (rs *RedisStore) ListBlockedBy(ctx context.Context, user Uuid) ([]Uuid, error) {
+	return rs.uuidSet(ctx, BlockedByRedisKey(user))
+}
+
+func IncomingFriendRequestsRedisKey(user Uuid) string {
+	return fmt.Sprintf("%s_incoming_friend_requests", user)
+}
+
+func OutgoingFriendRequestsRedisKey(user Uuid) string {
+	return fmt.Sprintf("%s_outgoing_friend_requests", user)
+}
+
+func (rs *RedisStore) AddFriendRequest(ctx context.Context, from, to Uuid, sentAt int64) error {
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, OutgoingFriendRequestsRedisKey(from), &redis.Z{
+			Score: float64(sentAt), Member: to.String(),
+		})
+		pipe.ZAdd(ctx, IncomingFriendRequestsRedisKey(to), &redis.Z{
+			Score: float64(sentAt), Member: from.String(),
+		})
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) DeleteFriendRequest(ctx context.Context, from, to Uuid) error {
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, OutgoingFriendRequestsRedisKey(from), to.String())
+		pipe.ZRem(ctx, IncomingFriendRequestsRedisKey(to), from.String())
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) HasFriendRequest(ctx context.Context, from, to Uuid) (bool, error) {
+	err := rs.Client.ZScore(ctx, OutgoingFriendRequestsRedisKey(from), to.String()).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (rs *RedisStore) IncomingFriendRequests(ctx context.Context, user Uuid) ([]Uuid, error) {
+	return rs.uuidSortedSet(ctx, IncomingFriendRequestsRedisKey(user))
+}
+
+func (rs *RedisStore) OutgoingFriendRequests(ctx context.Context, user Uuid) ([]Uuid, error) {
+	return rs.uuidSortedSet(ctx, OutgoingFriendRequestsRedisKey(user))
+}
+
+// Returns the members of a redis sorted set of uuids, ordered by their score.
+func (rs *RedisStore) uuidSortedSet(ctx context.Context, key string) ([]Uuid, error) {
+	uuidStrings, err := rs.Client.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	uuids := make([]Uuid, len(uuidStrings))
+	for i, uuidString := range uuidStrings {
+		uuids[i], err = UuidFromString(uuidString)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return uuids, nil
+}
+
+// Returns the members of a redis set of uuids.
+func (rs *RedisStore) uuidSet(ctx context.Context, key string) ([]Uuid, error) {
+	uuidStrings, err := rs.Client.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	uuids := make([]Uuid, len(uuidStrings))
+	for i, uuidString := range uuidStrings {
+		uuids[i], err = UuidFromString(uuidString)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return uuids, nil
+}
+
+func (rs *RedisStore) AddGroup(ctx context.Context, group *Group) error {
+	groupJSON, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	return rs.Client.HSet(ctx, "groups", group.Uuid.String(), groupJSON).Err()
+}
+
+func (rs *RedisStore) DeleteGroup(ctx context.Context, uuid Uuid) error {
+	err := rs.Client.HDel(ctx, "groups", uuid.String()).Err()
+	if err != nil {
+		return err
+	}
+	codes, err := rs.Client.SMembers(ctx, GroupInvitesRedisKey(uuid)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{
+		fmt.Sprintf("%s_group_users", uuid), GroupBansRedisKey(uuid), GroupInvitesRedisKey(uuid),
+		JoinRequestsRedisKey(uuid),
+	}
+	for _, code := range codes {
+		keys = append(keys, GroupInviteRedisKey(code))
+	}
+	return rs.Client.Del(ctx, keys...).Err()
+}
+
+func (rs *RedisStore) GetGroup(ctx context.Context, uuid Uuid) (*Group, error) {
+	groupJSON, err := rs.Client.HGet(ctx, "groups", uuid.String()).Bytes()
+	if err == redis.Nil || (err == nil && len(groupJSON) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var group Group
+	if err = json.Unmarshal(groupJSON, &group); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal group: %v", err)
+	}
+	return &group, nil
+}
+
+func (rs *RedisStore) GetGroups(ctx context.Context) ([]Group, error) {
+	groupJSONs, err := rs.Client.HVals(ctx, "groups").Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(groupJSONs) == 0 {
+		return nil, nil
+	}
+	out := make([]Group, len(groupJSONs))
+	for i, groupJSONs := range groupJSONs {
+		if err = json.Unmarshal([]byte(groupJSONs), &out[i]); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Set of the groups a user was added to, banned from or asked to join.
+func UserGroupsRedisKey(user Uuid) string {
+	return fmt.Sprintf("%s_user_groups", user)
+}
+
+// Adds the uuid of a user into a group.
+func (rs *RedisStore) AddUserToGroup(ctx context.Context, user, group Uuid) error {
+	groupUserKey := fmt.Sprintf("%s_group_users", group)
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, groupUserKey, user.String())
+		pipe.SAdd(ctx, UserGroupsRedisKey(user), group.String())
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) DeleteUserFromGroup(ctx context.Context, user, group Uuid) error {
+	groupUserKey := fmt.Sprintf("%s_group_users", group)
+	return rs.Client.SRem(ctx, groupUserKey, user.String()).Err()
+}
+
+func (rs *RedisStore) UserIsMemberOfGroup(ctx context.Context, user, group Uuid) (bool, error) {
+	groupUserKey := fmt.Sprintf("%s_group_users", group)
+	return rs.Client.SIsMember(ctx, groupUserKey, user.String()).Result()
+}
+
+// Finds the uuid of all users in a group.
+func (rs *RedisStore) UsersInGroup(ctx context.Context, group Uuid) ([]Uuid, error) {
+	groupUserKey := fmt.Sprintf("%s_group_users", group)
+	return rs.uuidSet(ctx, groupUserKey)
+}
+
+func (rs *RedisStore) GroupsForUser(ctx context.Context, user Uuid) ([]Uuid, error) {
+	return rs.uuidSet(ctx, UserGroupsRedisKey(user))
+}
+
+// Set of who is banned from a group.
+func GroupBansRedisKey(group Uuid) string {
+	return fmt.Sprintf("%s_group_banned", group)
+}
+
+func (rs *RedisStore) BanFromGroup(ctx context.Context, group, user Uuid) error {
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, GroupBansRedisKey(group), user.String())
+		pipe.SAdd(ctx, UserGroupsRedisKey(user), group.String())
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) UnbanFromGroup(ctx context.Context, group, user Uuid) error {
+	return rs.Client.SRem(ctx, GroupBansRedisKey(group), user.String()).Err()
+}
+
+func (rs *RedisStore) IsBannedFromGroup(ctx context.Context, group, user Uuid) (bool, error) {
+	return rs.Client.SIsMember(ctx, GroupBansRedisKey(group), user.String()).Result()
+}
+
+func (rs *RedisStore) BannedFromGroup(ctx context.Context, group Uuid) ([]Uuid, error) {
+	return rs.uuidSet(ctx, GroupBansRedisKey(group))
+}
+
+// Sorted set of who asked to join a group, scored by when they asked.
+func JoinRequestsRedisKey(group Uuid) string {
+	return fmt.Sprintf("%s_group_join_requests", group)
+}
+
+func (rs *RedisStore) AddJoinRequest(ctx context.Context, group, user Uuid, sentAt int64) error {
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, JoinRequestsRedisKey(group), &redis.Z{
+			Score: float64(sentAt), Member: user.String(),
+		})
+		pipe.SAdd(ctx, UserGroupsRedisKey(user), group.String())
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) DeleteJoinRequest(ctx context.Context, group, user Uuid) error {
+	return rs.Client.ZRem(ctx, JoinRequestsRedisKey(group), user.String()).Err()
+}
+
+func (rs *RedisStore) HasJoinRequest(ctx context.Context, group, user Uuid) (bool, error) {
+	err := rs.Client.ZScore(ctx, JoinRequestsRedisKey(group), user.String()).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (rs *RedisStore) JoinRequests(ctx context.Context, group Uuid) ([]Uuid, error) {
+	return rs.uuidSortedSet(ctx, JoinRequestsRedisKey(group))
+}
+
+// Set of the codes of invites to a group.
+func GroupInvitesRedisKey(group Uuid) string {
+	return fmt.Sprintf("%s_group_invites", group)
+}
+
+func (rs *RedisStore) AddGroupInvite(ctx context.Context, invite *GroupInvite) error {
+	inviteJSON, err := json.Marshal(invite)
+	if err != nil {
+		return err
+	}
+	duration := time.Until(time.Unix(invite.ValidUntil, 0))
+	_, err = rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, GroupInviteRedisKey(invite.Code), inviteJSON, duration)
+		pipe.SAdd(ctx, GroupInvitesRedisKey(invite.Group), invite.Code)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) GetGroupInvite(ctx context.Context, code string) (*GroupInvite, error) {
+	inviteJSON, err := rs.Client.Get(ctx, GroupInviteRedisKey(code)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var invite GroupInvite
+	if err = json.Unmarshal(inviteJSON, &invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (rs *RedisStore) DeleteGroupInvite(ctx context.Context, group Uuid, code string) error {
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, GroupInviteRedisKey(code))
+		pipe.SRem(ctx, GroupInvitesRedisKey(group), code)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) GroupInvites(ctx context.Context, group Uuid) ([]GroupInvite, error) {
+	codes, err := rs.Client.SMembers(ctx, GroupInvitesRedisKey(group)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(codes)
+	var out []GroupInvite
+	var expired []interface{}
+	for _, code := range codes {
+		invite, err := rs.GetGroupInvite(ctx, code)
+		if err != nil {
+			return nil, err
+		} else if invite == nil {
+			expired = append(expired, code)
+			continue
+		}
+		out = append(out, *invite)
+	}
+	if len(expired) > 0 {
+		if err = rs.Client.SRem(ctx, GroupInvitesRedisKey(group), expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (rs *RedisStore) AddMessage(ctx context.Context, msg *Message) error {
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	duration := time.Second * time.Duration(msg.TTL)
+	if err = rs.Client.Set(ctx, MessageRedisKey(msg.Uuid), msgJSON, duration).Err(); err != nil {
+		return err
+	}
+	var expiresAt time.Time
+	if msg.TTL > 0 {
+		expiresAt = time.Now().Add(duration)
+	}
+	return rs.indexSentBy(ctx, msg.Source.Uuid, MessageRedisKey(msg.Uuid), expiresAt)
+}
+
+func (rs *RedisStore) GetMessage(ctx context.Context, uuid Uuid) (*Message, error) {
+	msgJSON, err := rs.Client.Get(ctx, MessageRedisKey(uuid)).Bytes()
+	if err == redis.Nil || (err == nil && len(msgJSON) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var message Message
+	if err = json.Unmarshal(msgJSON, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func (rs *RedisStore) DeleteMessage(ctx context.Context, uuid Uuid) error {
+	return rs.Client.Del(ctx, MessageRedisKey(uuid)).Err()
+}
+
+func InboxRedisKey(user Uuid) string {
+	return fmt.Sprintf("%s_inbox", user)
+}
+
+func (rs *RedisStore) AddToInbox(ctx context.Context, recipient Uuid, msg *Message) error {
+	return rs.Client.ZAdd(ctx, InboxRedisKey(recipient), &redis.Z{
+		Score:  float64(msg.SentAt),
+		Member: msg.Uuid.String(),
+	}).Err()
+}
+
+func (rs *RedisStore) RemoveFromInbox(ctx context.Context, recipient, msg Uuid) error {
+	return rs.Client.ZRem(ctx, InboxRedisKey(recipient), msg.String()).Err()
+}
+
+func (rs *RedisStore) ClearInbox(ctx context.Context, recipient Uuid) error {
+	return rs.Client.Del(ctx, InboxRedisKey(recipient)).Err()
+}
+
+func (rs *RedisStore) InboxMessages(ctx context.Context, recipient Uuid) ([]*Message, error) {
+	uuidStrings, err := rs.Client.ZRange(ctx, InboxRedisKey(recipient), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var out []*Message
+	var expired []interface{}
+	for _, uuidString := range uuidStrings {
+		uuid, err := UuidFromString(uuidString)
+		if err != nil {
+			expired = append(expired, uuidString)
+			continue
+		}
+		msg, err := rs.GetMessage(ctx, uuid)
+		if err != nil {
+			return nil, err
+		} else if msg == nil || msg.Expired(now) {
+			expired = append(expired, uuidString)
+			continue
+		}
+		out = append(out, msg)
+	}
+	if len(expired) > 0 {
+		if err = rs.Client.ZRem(ctx, InboxRedisKey(recipient), expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (rs *RedisStore) AddReply(ctx context.Context, reply *MessageReply) error {
+	duration := time.Until(reply.Message.ExpiresAt())
+	if duration <= 0 {
+		return fmt.Errorf("Message being replied to has expired")
+	}
+	replyJSON, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	if err = rs.Client.Set(ctx, ReplyRedisKey(reply.Uuid), replyJSON, duration).Err(); err != nil {
+		return err
+	}
+	expiresAt := reply.Message.ExpiresAt()
+	if err = rs.indexSentBy(ctx, reply.From.Uuid, ReplyRedisKey(reply.Uuid), expiresAt); err != nil {
+		return err
+	}
+	// Replies also show who sent the message being replied to.
+	if source := reply.Message.Source.Uuid; source != reply.From.Uuid {
+		return rs.indexSentBy(ctx, source, ReplyRedisKey(reply.Uuid), expiresAt)
+	}
+	return nil
+}
+
+func (rs *RedisStore) GetReply(ctx context.Context, uuid Uuid) (*MessageReply, error) {
+	replyJSON, err := rs.Client.Get(ctx, ReplyRedisKey(uuid)).Bytes()
+	if err == redis.Nil || (err == nil && len(replyJSON) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var reply MessageReply
+	if err = json.Unmarshal(replyJSON, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func RepliesRedisKey(user Uuid) string {
+	return fmt.Sprintf("%s_replies", user)
+}
+
+func (rs *RedisStore) AddReplyForUser(ctx context.Context, user Uuid, reply *MessageReply) error {
+	return rs.Client.ZAdd(ctx, RepliesRedisKey(user), &redis.Z{
+		Score:  float64(reply.SentAt),
+		Member: reply.Uuid.String(),
+	}).Err()
+}
+
+func (rs *RedisStore) ClearRepliesForUser(ctx context.Context, user Uuid) error {
+	return rs.Client.Del(ctx, RepliesRedisKey(user)).Err()
+}
+
+func (rs *RedisStore) ListRepliesForUser(ctx context.Context, user Uuid) ([]*MessageReply, error) {
+	uuidStrings, err := rs.Client.ZRange(ctx, RepliesRedisKey(user), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var out []*MessageReply
+	var expired []interface{}
+	for _, uuidString := range uuidStrings {
+		uuid, err := UuidFromString(uuidString)
+		if err != nil {
+			expired = append(expired, uuidString)
+			continue
+		}
+		reply, err := rs.GetReply(ctx, uuid)
+		if err != nil {
+			return nil, err
+		} else if reply == nil || (reply.Message != nil && reply.Message.Expired(now)) {
+			expired = append(expired, uuidString)
+			continue
+		}
+		out = append(out, reply)
+	}
+	if len(expired) > 0 {
+		if err = rs.Client.ZRem(ctx, RepliesRedisKey(user), expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (rs *RedisStore) AddReport(ctx context.Context, report *Report) error {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return rs.Client.HSet(ctx, "reports", report.Uuid.String(), reportJSON).Err()
+}
+
+func (rs *RedisStore) ListReports(ctx context.Context) ([]Report, error) {
+	reportJSONs, err := rs.Client.HVals(ctx, "reports").Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Report, len(reportJSONs))
+	for i, reportJSON := range reportJSONs {
+		if err = json.Unmarshal([]byte(reportJSON), &out[i]); err != nil {
+			return nil, err
+		}
+	}
+	sortReports(out)
+	return out, nil
+}
+
+func (rs *RedisStore) DeleteReport(ctx context.Context, uuid Uuid) error {
+	return rs.Client.HDel(ctx, "reports", uuid.String()).Err()
+}
+
+func (rs *RedisStore) IncrEmojiSent(ctx context.Context, e EmojiContent) error {
+	return rs.Client.HIncrBy(ctx, "emojis_sent", string(e), 1).Err()
+}
+
+func (rs *RedisStore) EmojiSentAt(ctx context.Context, e EmojiContent) (float64, bool, error) {
+	timeString, err := rs.Client.HGet(ctx, "emoji_sent_at", string(e)).Result()
+	if err == redis.Nil {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	timeRaw, err := strconv.ParseFloat(timeString, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return timeRaw, true, nil
+}
+
+func (rs *RedisStore) SetEmojiSentAt(ctx context.Context, e EmojiContent, localTime float64) error {
+	return rs.Client.HSet(
+		ctx, "emoji_sent_at", string(e), strconv.FormatFloat(localTime, 'E', -1, 64),
+	).Err()
+}
+
+func (rs *RedisStore) RandomEmojiSentAt(ctx context.Context, n int) (map[EmojiContent]float64, error) {
+	vals, err := rs.Client.HRandField(ctx, "emoji_sent_at", n, true).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[EmojiContent]float64, len(vals)/2)
+	for i := 0; i+1 < len(vals); i += 2 {
+		t, err := strconv.ParseFloat(vals[i+1], 64)
+		if err != nil {
+			continue
+		}
+		out[EmojiContent(vals[i])] = t
+	}
+	return out, nil
+}
+
+func (rs *RedisStore) IncrReply(ctx context.Context, original EmojiContent, reply EmojiReply) error {
+	replyString := string(reply)
+	if err := rs.Client.HIncrBy(ctx, "emoji_reply", replyString, 1).Err(); err != nil {
+		return err
+	}
+	return rs.Client.HIncrBy(ctx, original.RedisKey(), replyString, 1).Err()
+}
+
+func (rs *RedisStore) Summary(ctx context.Context) (*SummaryResponse, error) {
+	emojisSent, err := rs.Client.HGetAll(ctx, "emojis_sent").Result()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get counts: %v", err)
+	}
+	emojisSentAt, err := rs.Client.HGetAll(ctx, "emoji_sent_at").Result()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get times: %v", err)
+	}
+	repliesSent, err := rs.Client.HGetAll(ctx, "emoji_reply").Result()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get replies: %v", err)
+	}
+	out := SummaryResponse{
+		Counts:         make(map[string]int, len(emojisSent)),
+		Times:          make(map[string]float64, len(emojisSentAt)),
+		ReplyCounts:    make(map[string]int, len(repliesSent)),
+		MessageReplies: map[string]map[string]int{},
+	}
+	for emojis, count := range emojisSent {
+		out.Counts[emojis], err = strconv.Atoi(count)
+		if err != nil {
+			fmt.Printf("Failed to parse count: %v", err)
+			continue
+		}
+	}
+	for emojis, sentAt := range emojisSentAt {
+		out.Times[emojis], err = strconv.ParseFloat(sentAt, 64)
+		if err != nil {
+			fmt.Printf("Failed to parse time: %v", err)
+			continue
+		}
+	}
+	for replies, count := range repliesSent {
+		out.ReplyCounts[replies], err = strconv.Atoi(count)
+		if err != nil {
+			fmt.Printf("Failed to parse reply count: %v", err)
+			continue
+		}
+	}
+	emojiKeys, err := rs.Client.Keys(ctx, "emojis_*").Result()
+	if err == nil {
+		for _, key := range emojiKeys {
+			var emojiString string
+			_, err := fmt.Sscanf(key, "emojis_%s", &emojiString)
+			if err != nil {
+				continue
+			}
+			replyCounts := map[string]int{}
+			replyPairs, err := rs.Client.HGetAll(ctx, key).Result()
+			if err != nil {
+				continue
+			}
+			for reply, count := range replyPairs {
+				count, err := strconv.Atoi(count)
+				if err != nil {
+					continue
+				}
+				replyCounts[reply] = count
+			}
+			out.MessageReplies[emojiString] = replyCounts
+		}
+	}
+	return &out, nil
+}
+
+func (rs *RedisStore) Reset(ctx context.Context) error {
+	return rs.Client.FlushAll(ctx).Err()
+}
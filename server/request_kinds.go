@@ -16,7 +16,7 @@ type ListPeopleRequest struct {
 }
 
 type ListPeopleResponse struct {
-	People []User `json:"people"`
+	People []PublicUser `json:"people"`
 }
 
 type AckMsgRequest struct {
@@ -44,8 +44,18 @@ type RecvMsgResponse struct {
 type FriendAction int
 
 const (
+	// Stops being friends with Other.
 	Rmfriend FriendAction = iota
+	// Asks Other to be friends, or accepts if they already asked.
 	AddFriend
+	// Accepts the request Other sent.
+	AcceptFriend
+	// Declines the request Other sent.
+	DeclineFriend
+	// Takes back the request sent to Other.
+	CancelFriend
+	// Lists the requests which were sent and received, which is a ListFriendRequestsResponse.
+	ListFriendRequests
 )
 
 type FriendRequest struct {
@@ -54,24 +64,191 @@ type FriendRequest struct {
 	Action     FriendAction `json:"action"`
 }
 
+type BlockOp int
+
+const (
+	BlockUser BlockOp = iota
+	UnblockUser
+	// Lists who the user has blocked, which is a ListBlockedResponse.
+	ListBlockedOp
+)
+
+type BlockRequest struct {
+	Kind BlockOp `json:"kind"`
+	// User to block or unblock.
+	Other Uuid `json:"other,omitempty,string"`
+
+	LoginToken LoginToken `json:"loginToken"`
+}
+
+type ListBlockedResponse struct {
+	Blocked []PublicUser `json:"blocked"`
+}
+
+type ListFriendRequestsResponse struct {
+	// Users who asked to be friends, oldest first.
+	Incoming []PublicUser `json:"incoming"`
+	// Users who were asked to be friends, oldest first.
+	Outgoing []PublicUser `json:"outgoing"`
+}
+
 type SignUpRequest struct {
 	Email          string `json:"email"`
 	Name           string `json:"name"`
 	HashedPassword string `json:"hashedPassword"`
+	// Name of the device signing up, shown when listing sessions.
+	Device string `json:"device"`
 }
 
 type LoginRequest struct {
 	Email          string `json:"email"`
 	HashedPassword string `json:"hashedPassword"`
+	// Name of the device logging in, shown when listing sessions.
+	Device string `json:"device"`
 }
 
 // Also doubles as SignupResponse
 type LoginResponse struct {
 	User User `json:"user"`
 
+	LoginToken LoginToken `json:"loginToken"`
+	// Opaque token which should be sent as "Authorization: Bearer <SessionToken>". It expires
+	// at SessionTokenValidUntil, after which RefreshToken gets a new one.
+	SessionToken           string `json:"sessionToken"`
+	SessionTokenValidUntil int64  `json:"sessionTokenValidUntil,string"`
+	RefreshToken           string `json:"refreshToken"`
+}
+
+type VerifyEmailOp int
+
+const (
+	// Sends a new verification code, replacing any earlier one.
+	ResendVerification VerifyEmailOp = iota
+	ConfirmVerification
+)
+
+type VerifyEmailRequest struct {
+	Kind VerifyEmailOp `json:"kind"`
+	// Code which was emailed, for ConfirmVerification.
+	Code string `json:"code,omitempty"`
+
+	LoginToken LoginToken `json:"loginToken"`
+}
+
+type ResetPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ConfirmResetPasswordRequest struct {
+	Email string `json:"email"`
+	// Code which was emailed after a ResetPasswordRequest.
+	Code              string `json:"code"`
+	NewHashedPassword string `json:"newHashedPassword"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Every refresh replaces both tokens, and the old refresh token must not be used again.
+type RefreshResponse struct {
+	SessionToken           string `json:"sessionToken"`
+	SessionTokenValidUntil int64  `json:"sessionTokenValidUntil,string"`
+	RefreshToken           string `json:"refreshToken"`
+}
+
+type SessionOp int
+
+const (
+	ListSessions SessionOp = iota
+	// Logs out a single session, which may be the current one.
+	RevokeSession
+	// Logs out every session of the user, including the current one.
+	RevokeAllSessions
+)
+
+// Changes the profile of the user who sent it. Fields which are not set are left unchanged.
+type UpdateProfileRequest struct {
+	Name            *string   `json:"name,omitempty"`
+	DefaultTTL      *int64    `json:"defaultTTL,string,omitempty"`
+	TimeZone        *string   `json:"timeZone,omitempty"`
+	QuietHoursStart *int      `json:"quietHoursStart,omitempty"`
+	QuietHoursEnd   *int      `json:"quietHoursEnd,omitempty"`
+	Undiscoverable  *bool     `json:"undiscoverable,omitempty"`
+	DirectMessages  *DMPolicy `json:"directMessages,omitempty"`
+
 	LoginToken LoginToken `json:"loginToken"`
 }
 
+type DeleteAccountRequest struct {
+	// The user's password must be sent again to delete their account.
+	HashedPassword string `json:"hashedPassword"`
+
+	LoginToken LoginToken `json:"loginToken"`
+}
+
+type LogoutRequest struct {
+	// Log out of every session of the user instead of only the current one.
+	Everywhere bool `json:"everywhere"`
+
+	LoginToken LoginToken `json:"loginToken"`
+}
+
+type SessionRequest struct {
+	Kind SessionOp `json:"kind"`
+	// Session to revoke for RevokeSession.
+	Session Uuid `json:"session,omitempty,string"`
+
+	LoginToken LoginToken `json:"loginToken"`
+}
+
+// What a user can see about one of their sessions.
+type SessionInfo struct {
+	Uuid   Uuid   `json:"uuid,string"`
+	Device string `json:"device"`
+	// Unix timestamps
+	CreatedAt int64 `json:"createdAt,string"`
+	LastSeen  int64 `json:"lastSeen,string"`
+	// Whether this is the session which made the request.
+	Current bool `json:"current"`
+}
+
+type ListSessionsResponse struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// Reports a message, user or group to the admins.
+type ReportRequest struct {
+	Kind   ReportKind `json:"kind"`
+	Target Uuid       `json:"target,string"`
+	Reason string     `json:"reason"`
+
+	LoginToken LoginToken `json:"loginToken"`
+}
+
+type AdminOp int
+
+const (
+	ListReportsOp AdminOp = iota
+	// Removes a report from the moderation queue once it has been dealt with.
+	DismissReport
+	// Logs a user out everywhere and stops them from logging in again.
+	SuspendUser
+	UnsuspendUser
+	DeleteGroupAsAdmin
+)
+
+// A request to the admin API, which is authorized by the admin token instead of a login token.
+type AdminRequest struct {
+	Kind AdminOp `json:"kind"`
+	// The report, user or group the op is for.
+	Target Uuid `json:"target,omitempty,string"`
+}
+
+type ListReportsResponse struct {
+	Reports []Report `json:"reports"`
+}
+
 type MessageRecipientKind int
 
 const (
@@ -99,6 +276,30 @@ const (
 	LeaveGroup
 	CreateGroup
 	SwitchLockGroup
+	// Changes the name of a group to GroupName.
+	RenameGroup
+	// Removes Other from a group.
+	KickFromGroup
+	// Makes Other an admin of a group.
+	PromoteInGroup
+	// Makes Other no longer an admin of a group, which only the owner can do.
+	DemoteInGroup
+	// Creates an invite which lets people join a group while it is locked.
+	CreateGroupInvite
+	ListGroupInvites
+	RevokeGroupInvite
+	// Asks the admins of a locked group to let the user join it.
+	RequestToJoinGroup
+	ListJoinRequests
+	// Lets Other join a group they asked to join.
+	ApproveJoinRequest
+	RejectJoinRequest
+	// Changes the description, emoji, location or member limit of a group.
+	UpdateGroupInfo
+	// Removes Other from a group if they are in it, and stops them from joining it again.
+	BanFromGroupOp
+	UnbanFromGroupOp
+	ListBannedFromGroup
 )
 
 type GroupRequest struct {
@@ -107,6 +308,23 @@ type GroupRequest struct {
 	// identification for now.
 	GroupName string `json:"groupName"`
 	GroupUuid Uuid   `json:"groupUuid,omitempty,string"`
+	// Member of the group who is kicked, banned, unbanned, promoted or demoted, or whose request
+	// to join is approved or rejected.
+	Other Uuid `json:"other,omitempty,string"`
+	// Invite to join with, or to revoke. GroupUuid can be left out when joining with an invite.
+	InviteCode string `json:"inviteCode,omitempty"`
+	// For CreateGroupInvite, how many times the invite can be used, or 0 for no limit, and the
+	// number of seconds it lasts for, or 0 for a week.
+	InviteMaxUses int   `json:"inviteMaxUses,omitempty"`
+	InviteTTL     int64 `json:"inviteTTL,string,omitempty"`
+	// For CreateGroup and UpdateGroupInfo. Fields which are not set are left unchanged.
+	Description *string       `json:"description,omitempty"`
+	Emoji       *EmojiContent `json:"emoji,omitempty"`
+	Location    *GeoLocation  `json:"location,omitempty"`
+	// Removes the location of a group for UpdateGroupInfo.
+	ClearLocation bool  `json:"clearLocation,omitempty"`
+	MemberLimit   *int  `json:"memberLimit,omitempty"`
+	LockWhenFull  *bool `json:"lockWhenFull,omitempty"`
 
 	// User's login token
 	LoginToken LoginToken `json:"loginToken"`
@@ -126,6 +344,21 @@ type ListGroupRequest struct {
 	Amount     int           `json:"amount"`
 	LoginToken LoginToken    `json:"loginToken"`
 	Filter     MatchFilter   `json:"filter"`
+	// Only lists groups within WithinKm kilometers of Near, nearest first, if set.
+	Near     *GeoLocation `json:"near,omitempty"`
+	WithinKm float64      `json:"withinKm,omitempty"`
+}
+
+type ListGroupInvitesResponse struct {
+	Invites []GroupInvite `json:"invites"`
+}
+
+type ListBannedFromGroupResponse struct {
+	Banned []PublicUser `json:"banned"`
+}
+
+type ListJoinRequestsResponse struct {
+	Requests []PublicUser `json:"requests"`
 }
 
 type ListGroupResponse struct {
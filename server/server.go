@@ -2,19 +2,14 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/subtle"
 	"expvar"
 	"fmt"
 	"math"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
-
-	"github.com/go-redis/redis/v8"
 )
 
 func main() {
@@ -31,386 +26,349 @@ func main() {
 // Server is a stateful server which represents the current state of the
 // universe. For now it should just be a massive struct which contains everything for
 // simplicity.
+//
+// Every request is handled on its own goroutine, so Server keeps no mutable state in memory
+// besides locks, and everything else lives in the Store. Store methods are atomic on their own,
+// but updates which read a record, modify it and write it back must hold the lock for that
+// record for their duration.
 type Server struct {
-	// mu guards the map of struct who have signed up
+	// mu guards updates to the emoji statistics.
 	mu sync.Mutex
-	// LoggedIn map[Email]LoginToken
-
-	// In-memory map of recipient to Messages
-	UserToMessages map[Uuid]map[Uuid]struct{}
-
-	// TODO this isn't really in use so it's okay that it gets reset
-	// List of friends for a given user: user -> their friends
-	Friends map[Uuid]map[Uuid]struct{}
 
-	// Replies waiting for a given user
-	UserToReplies map[Uuid][]Uuid
-	Replies       map[Uuid]*MessageReply
-
-	// A long living redis client for using as a persistent store.
-	RedisClient *redis.Client
+	// userLocks guards read-modify-write updates to a User.
+	userLocks shardedMutex
+	// groupLocks guards read-modify-write updates to a Group.
+	groupLocks shardedMutex
+	// friendLocks guards updates to the friendship and friend requests between two users, and
+	// must be locked with LockPair.
+	friendLocks shardedMutex
+	// sessionLocks guards read-modify-write updates to a Session.
+	sessionLocks shardedMutex
+	// emailCodeLocks guards read-modify-write updates to the EmailCodes of a user.
+	emailCodeLocks shardedMutex
+
+	// Sends emails to users.
+	Mailer Mailer
+	// What users who have not verified their email cannot do.
+	Unverified UnverifiedRestrictions
+	// Bearer token for the admin API, which is disabled if it is empty.
+	AdminToken string
+	// Most members any group can have, or defaultMaxGroupSize if 0.
+	MaxGroupSize int
+
+	// Persistent store for everything, which is redis unless MOJI_STORE=memory.
+	Store
 }
 
 func NewServer() *Server {
-	redisURL := os.Getenv("REDIS_URL")
-	user := ""
-	password := ""
-	if redisURL == "" {
-		redisURL = ":6379"
-	} else {
-		u, err := url.Parse(redisURL)
-		if err != nil {
-			fmt.Println(err)
-		}
-		redisURL = u.Host
-		user = u.User.Username()
-		password, _ = u.User.Password()
-	}
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     strings.TrimSuffix(redisURL, ":"),
-		Username: user,
-		// TODO need to set a password through secret.
-		Password: password,
-		DB:       0,
-	})
-	// ping the local redis database
-	if _, err := rdb.Ping(context.Background()).Result(); err != nil {
-		fmt.Printf("Failed to open ping redis: %v\n", err)
+	var store Store
+	switch storeKind := os.Getenv("MOJI_STORE"); storeKind {
+	case "", "redis":
+		store = NewRedisStore()
+	case "memory":
+		store = NewMemoryStore()
+	default:
+		fmt.Printf("Unknown MOJI_STORE %q, using redis\n", storeKind)
+		store = NewRedisStore()
 	}
 	return &Server{
-		// SignedUp:        map[Email]*User{},
-		// LoggedIn: map[Email]LoginToken{},
+		Store:        store,
+		Mailer:       NewMailer(),
+		Unverified:   UnverifiedRestrictionsFromEnv(),
+		AdminToken:   os.Getenv("MOJI_ADMIN_TOKEN"),
+		MaxGroupSize: maxGroupSizeFromEnv(),
+	}
+}
 
-		UserToMessages: map[Uuid]map[Uuid]struct{}{},
+// Number of mutexes a shardedMutex spreads its keys over.
+const lockShards = 64
 
-		Friends: map[Uuid]map[Uuid]struct{}{},
+// shardedMutex is a fixed set of mutexes, where each Uuid always maps to the same mutex. This
+// allows for locking individual records without keeping a lock per record around.
+type shardedMutex [lockShards]sync.Mutex
 
-		UserToReplies: map[Uuid][]Uuid{},
-		Replies:       map[Uuid]*MessageReply{},
+// Locks the shard for uuid, and returns a function which will unlock it.
+func (sm *shardedMutex) Lock(uuid Uuid) func() {
+	mu := &sm[uint64(uuid)%lockShards]
+	mu.Lock()
+	return mu.Unlock
+}
 
-		RedisClient: rdb,
+// Locks the shards for both a and b, always in the same order so that locking a pair cannot
+// deadlock, and returns a function which will unlock them.
+func (sm *shardedMutex) LockPair(a, b Uuid) func() {
+	i, j := uint64(a)%lockShards, uint64(b)%lockShards
+	if i == j {
+		return sm.Lock(a)
+	} else if i > j {
+		i, j = j, i
+	}
+	sm[i].Lock()
+	sm[j].Lock()
+	return func() {
+		sm[j].Unlock()
+		sm[i].Unlock()
 	}
 }
 
 func (srv *Server) Serve(addr string) error {
+	s := http.Server{
+		Addr:           addr,
+		Handler:        srv.Handler(),
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	if err := srv.indexGroupMembers(context.Background()); err != nil {
+		return err
+	}
+	if err := srv.assignGroupOwners(context.Background()); err != nil {
+		return err
+	}
+	fmt.Println("Listening on", s.Addr, "...")
+	return s.ListenAndServe()
+}
+
+// Handler returns the handler which serves all routes of the server.
+func (srv *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/sign_up/", srv.SignUpHandler())
 	mux.HandleFunc("/api/v1/login/", srv.LoginHandler())
+	mux.HandleFunc("/api/v1/refresh/", srv.RefreshHandler())
+	mux.HandleFunc("/api/v1/logout/", srv.authenticated(srv.LogoutHandler()))
+	mux.HandleFunc("/api/v1/profile/", srv.authenticated(srv.ProfileHandler()))
+	mux.HandleFunc("/api/v1/delete_account/", srv.authenticated(srv.DeleteAccountHandler()))
+	mux.HandleFunc("/api/v1/verify_email/", srv.authenticated(srv.VerifyEmailHandler()))
+	mux.HandleFunc("/api/v1/reset_password/", srv.ResetPasswordHandler())
+	mux.HandleFunc("/api/v1/confirm_reset_password/", srv.ConfirmResetPasswordHandler())
+	mux.HandleFunc("/api/v1/sessions/", srv.authenticated(srv.SessionHandler()))
 
-	mux.HandleFunc("/api/v1/friend/", srv.FriendHandler())
-	mux.HandleFunc("/api/v1/groups/", srv.GroupHandler())
+	mux.HandleFunc("/api/v1/friend/", srv.authenticated(srv.FriendHandler()))
+	mux.HandleFunc("/api/v1/block/", srv.authenticated(srv.BlockHandler()))
+	mux.HandleFunc("/api/v1/groups/", srv.authenticated(srv.GroupHandler()))
 
-	mux.HandleFunc("/api/v1/list_friends/", srv.ListPeopleHandler())
-	mux.HandleFunc("/api/v1/list_groups/", srv.ListGroupHandler())
+	mux.HandleFunc("/api/v1/list_friends/", srv.authenticated(srv.ListPeopleHandler()))
+	mux.HandleFunc("/api/v1/list_groups/", srv.authenticated(srv.ListGroupHandler()))
 
-	mux.HandleFunc("/api/v1/send_msg/", srv.SendMsgHandler())
-	mux.HandleFunc("/api/v1/recv_msg/", srv.RecvMsgHandler())
-	mux.HandleFunc("/api/v1/ack_msg/", srv.AckMsgHandler())
+	mux.HandleFunc("/api/v1/send_msg/", srv.authenticated(srv.SendMsgHandler()))
+	mux.HandleFunc("/api/v1/recv_msg/", srv.authenticated(srv.RecvMsgHandler()))
+	mux.HandleFunc("/api/v1/ack_msg/", srv.authenticated(srv.AckMsgHandler()))
+
+	mux.HandleFunc("/api/v1/report/", srv.authenticated(srv.ReportHandler()))
+	mux.HandleFunc("/api/v1/admin/", srv.admin(srv.AdminHandler()))
 
 	mux.HandleFunc("/api/v1/recs/", srv.RecommendationHandler())
 
-	mux.HandleFunc("/api/v1/push_token/", srv.PushNotifTokenHandler())
+	mux.HandleFunc("/api/v1/push_token/", srv.authenticated(srv.PushNotifTokenHandler()))
 
 	mux.HandleFunc("/api/v1/summary/", srv.SummaryHandler())
 
 	mux.Handle("/debug/vars", expvar.Handler())
 	mux.Handle("/debug/reset_redis", srv.ResetRedis())
-
-	s := http.Server{
-		Addr:           addr,
-		Handler:        mux,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
-	}
-	fmt.Println("Listening on", s.Addr, "...")
-	return s.ListenAndServe()
+	return mux
 }
 
-func (s *Server) AddMessage(ctx context.Context, msg *Message) error {
-	msgJSON, err := json.Marshal(msg)
-	if err != nil {
-		return nil
-	}
-	duration := time.Second * time.Duration(msg.TTL)
-	return s.RedisClient.Set(ctx, MessageRedisKey(msg.Uuid), msgJSON, duration).Err()
-}
-
-func (s *Server) GetMessage(ctx context.Context, uuid Uuid) (*Message, error) {
-	msgJSON, err := s.RedisClient.Get(ctx, MessageRedisKey(uuid)).Bytes()
+func (s *Server) SignUp(ctx context.Context, userEmail Email, userName string, hashedPassword string) (Uuid, error) {
+	uuid, err := generateUuid()
 	if err != nil {
-		return nil, err
-	}
-	if len(msgJSON) == 0 {
-		return nil, nil
-	}
-	var message Message
-	if err = json.Unmarshal(msgJSON, &message); err != nil {
-		return nil, err
+		return Uuid(0), err
 	}
-	return &message, nil
-}
-
-func (s *Server) DeleteMessage(ctx context.Context, uuid Uuid) error {
-	return s.RedisClient.HDel(ctx, "messages", uuid.String()).Err()
-}
-
-func (s *Server) AddUser(ctx context.Context, user *User) error {
-	userJSON, err := json.Marshal(user)
-	if err != nil {
-		return err
+	user := &User{
+		Name:  userName,
+		Email: userEmail,
+		Uuid:  uuid,
 	}
-	return s.RedisClient.HSet(ctx, "users", user.Uuid.String(), userJSON).Err()
-}
-
-func (s *Server) GetUser(ctx context.Context, uuid Uuid) (*User, error) {
-	userJSON, err := s.RedisClient.HGet(ctx, "users", uuid.String()).Bytes()
+	passwordHash, err := hashPassword(hashedPassword)
 	if err != nil {
-		return nil, err
-	}
-	if len(userJSON) == 0 {
-		return nil, nil
+		return Uuid(0), err
 	}
-	var user User
-	if err = json.Unmarshal(userJSON, &user); err != nil {
-		return nil, fmt.Errorf("Failed to unmarshal user: %v", err)
+	if err = s.CreateUser(ctx, user, passwordHash); err != nil {
+		return Uuid(0), err
 	}
-	return &user, nil
+	return uuid, nil
 }
 
-func (s *Server) GetUsers(ctx context.Context) ([]User, error) {
-	userJSONs, err := s.RedisClient.HVals(ctx, "users").Result()
+// Applies update to the latest version of a user and saves it, returning the updated user.
+func (s *Server) updateUser(ctx context.Context, uuid Uuid, update func(*User) error) (*User, error) {
+	defer s.userLocks.Lock(uuid)()
+	user, err := s.GetUser(ctx, uuid)
 	if err != nil {
 		return nil, err
+	} else if user == nil {
+		return nil, fmt.Errorf("User does not exist")
 	}
-	if len(userJSONs) == 0 {
-		return nil, nil
+	if err = update(user); err != nil {
+		return nil, err
 	}
-	out := make([]User, len(userJSONs))
-	for i, userJSON := range userJSONs {
-		if err = json.Unmarshal([]byte(userJSON), &out[i]); err != nil {
-			return nil, err
-		}
+	if err = s.AddUser(ctx, user); err != nil {
+		return nil, err
 	}
-	return out, nil
+	return user, nil
 }
 
-func (s *Server) AddGroup(ctx context.Context, group *Group) error {
-	groupJSON, err := json.Marshal(group)
-	if err != nil {
-		return err
-	}
-	return s.RedisClient.HSet(ctx, "groups", group.Uuid.String(), groupJSON).Err()
-}
+// Who messages and replies of deleted users are shown as being from.
+var deletedUser = PublicUser{Uuid: InvalidUuid, Name: "Deleted user"}
 
-func (s *Server) DeleteGroup(ctx context.Context, uuid Uuid) error {
-	err := s.RedisClient.HDel(ctx, "groups", uuid.String()).Err()
-	if err != nil {
+// Deletes a user's account, removing them from every group and friend list and erasing
+// everything kept for them. Messages they sent which have not expired yet are kept for their
+// recipients, but no longer say who sent them.
+func (s *Server) DeleteAccount(ctx context.Context, user *User) error {
+	// Log out everywhere first so that nothing is added for the user while deleting.
+	if err := s.revokeAllSessions(ctx, user.Uuid); err != nil {
 		return err
 	}
-	groupUserKey := fmt.Sprintf("%s_group_users", uuid)
-	return s.RedisClient.Del(ctx, groupUserKey).Err()
-}
-
-func (s *Server) GetGroup(ctx context.Context, uuid Uuid) (*Group, error) {
-	groupJSON, err := s.RedisClient.HGet(ctx, "groups", uuid.String()).Bytes()
-	if err != nil {
-		return nil, err
-	}
-	if len(groupJSON) == 0 {
-		return nil, nil
-	}
-	var group Group
-	if err = json.Unmarshal(groupJSON, &group); err != nil {
-		return nil, fmt.Errorf("Failed to unmarshal user: %v", err)
-	}
-	return &group, nil
-}
-
-func (s *Server) GetGroups(ctx context.Context) ([]Group, error) {
-	groupJSONs, err := s.RedisClient.HVals(ctx, "groups").Result()
+	groups, err := s.GroupsForUser(ctx, user.Uuid)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if len(groupJSONs) == 0 {
-		return nil, nil
+	for _, group := range groups {
+		if err = s.DeleteJoinRequest(ctx, group, user.Uuid); err != nil {
+			return err
+		}
+		if err = s.UnbanFromGroup(ctx, group, user.Uuid); err != nil {
+			return err
+		}
+		if _, err = s.leaveGroup(ctx, user.Uuid, group); err != nil && err != errNotGroupMember {
+			return err
+		}
 	}
-	out := make([]Group, len(groupJSONs))
-	for i, groupJSONs := range groupJSONs {
-		if err = json.Unmarshal([]byte(groupJSONs), &out[i]); err != nil {
-			return nil, err
+	// Friends and friend requests in either direction are all removed by removeFriend.
+	var others []Uuid
+	for _, list := range []func(context.Context, Uuid) ([]Uuid, error){
+		s.ListFriends, s.IncomingFriendRequests, s.OutgoingFriendRequests,
+	} {
+		uuids, err := list(ctx, user.Uuid)
+		if err != nil {
+			return err
 		}
+		others = append(others, uuids...)
 	}
-	return out, nil
-}
-
-// Adds the uuid of a user into a group.
-func (s *Server) AddUserToGroup(ctx context.Context, user, group Uuid) error {
-	groupUserKey := fmt.Sprintf("%s_group_users", group)
-	return s.RedisClient.SAdd(ctx, groupUserKey, user.String()).Err()
-}
-
-func (s *Server) DeleteUserFromGroup(ctx context.Context, user, group Uuid) error {
-	groupUserKey := fmt.Sprintf("%s_group_users", group)
-	return s.RedisClient.SRem(ctx, groupUserKey, user.String()).Err()
-}
-
-func (s *Server) UserIsMemberOfGroup(ctx context.Context, user, group Uuid) (bool, error) {
-	groupUserKey := fmt.Sprintf("%s_group_users", group)
-	return s.RedisClient.SIsMember(ctx, groupUserKey, user.String()).Result()
-}
-
-// Finds the uuid of all users in a group.
-func (s *Server) UsersInGroupRaw(ctx context.Context, group Uuid) ([]string, error) {
-	groupUserKey := fmt.Sprintf("%s_group_users", group)
-	uuidStrings, err := s.RedisClient.SMembers(ctx, groupUserKey).Result()
-	if err != nil {
-		return nil, err
+	for _, other := range others {
+		if err = s.removeFriend(ctx, user.Uuid, other); err != nil {
+			return err
+		}
 	}
-	return uuidStrings, nil
-}
-
-// Finds the uuid of all users in a group.
-func (s *Server) UsersInGroup(ctx context.Context, group Uuid) ([]Uuid, error) {
-	uuidStrings, err := s.UsersInGroupRaw(ctx, group)
+	blocked, err := s.ListBlocked(ctx, user.Uuid)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	uuids := make([]Uuid, len(uuidStrings))
-	for i, uuidString := range uuidStrings {
-		uuids[i], err = UuidFromString(uuidString)
-		if err != nil {
-			return nil, err
+	for _, other := range blocked {
+		if err = s.Unblock(ctx, user.Uuid, other); err != nil {
+			return err
 		}
 	}
-	return uuids, nil
-}
-
-func (s *Server) SignUp(ctx context.Context, userEmail Email, userName string, hashedPassword string) (Uuid, error) {
-	exists, err := s.RedisClient.HExists(ctx, "signed_up", string(userEmail)).Result()
-	if err != nil {
-		return Uuid(0), fmt.Errorf("Error signing up: %v", err)
-	} else if exists {
-		return Uuid(0), fmt.Errorf("User already exists")
-	}
-
-	uuid, err := generateUuid()
+	blockedBy, err := s.ListBlockedBy(ctx, user.Uuid)
 	if err != nil {
-		return Uuid(0), err
+		return err
 	}
-	user := &User{
-		Name:  userName,
-		Email: userEmail,
-		Uuid:  uuid,
+	for _, other := range blockedBy {
+		if err = s.Unblock(ctx, other, user.Uuid); err != nil {
+			return err
+		}
 	}
-	userJSON, err := json.Marshal(user)
-	if err != nil {
-		return Uuid(0), fmt.Errorf("Failed to marshal user: %v", err)
+	if err = s.AnonymizeUser(ctx, user.Uuid, deletedUser); err != nil {
+		return err
 	}
-	// TODO below needs to be in a transaction with above as well?
-	s.RedisClient.HSet(ctx, "signed_up", string(userEmail), userJSON)
-	s.RedisClient.HSet(ctx, "hashed_passwords", uuid.String(), hashedPassword)
-	s.RedisClient.HSet(ctx, "users", uuid.String(), userJSON)
-
-	return uuid, nil
+	defer s.userLocks.Lock(user.Uuid)()
+	return s.DeleteUser(ctx, user)
 }
 
-func (s *Server) Login(ctx context.Context, userEmail Email, hashedPassword string) (LoginToken, error) {
+// Logs a user in, creating a new session for them.
+func (s *Server) Login(ctx context.Context, userEmail Email, hashedPassword, device string) (*LoginResponse, error) {
 	if hashedPassword == "" {
-		return LoginToken{}, fmt.Errorf("password must not be empty")
+		return nil, fmt.Errorf("password must not be empty")
 	}
 
-	userJSON, err := s.RedisClient.HGet(ctx, "signed_up", string(userEmail)).Bytes()
+	user, err := s.UserByEmail(ctx, userEmail)
 	if err != nil {
-		return LoginToken{}, err
-	} else if len(userJSON) == 0 {
+		return nil, err
+	} else if user == nil {
 		// Show generic error message, but user does not exist
-		return LoginToken{}, fmt.Errorf("Something wrong with login")
-	}
-	var user User
-	if err = json.Unmarshal(userJSON, &user); err != nil {
-		return LoginToken{}, fmt.Errorf("Something wrong with login")
+		return nil, fmt.Errorf("Something wrong with login")
 	}
 	if user.Email != userEmail {
-		return LoginToken{}, fmt.Errorf("Something wrong with login")
+		return nil, fmt.Errorf("Something wrong with login")
 	}
-	existing, err := s.RedisClient.HGet(ctx, "hashed_passwords", user.Uuid.String()).Result()
-	if err != nil || existing != hashedPassword {
+	existing, err := s.PasswordHash(ctx, user.Uuid)
+	if err != nil || !checkPassword(existing, hashedPassword) {
 		// Show generic error message, but password isn't right
-		return LoginToken{}, fmt.Errorf("Something wrong with login")
-	}
-
-	// TODO check collisions of the uuid and retry or crash
-	uuid, err := generateUuid()
-	if err != nil {
-		return LoginToken{}, err
+		return nil, fmt.Errorf("Something wrong with login")
 	}
-
-	loginToken := LoginToken{
-		// make the token valid for extremely long periods of time.
-		ValidUntil: time.Now().Add(365 * 24 * time.Hour).Unix(),
-		Uuid:       uuid,
-		UserEmail:  userEmail,
+	if user.Suspended {
+		return nil, errSuspended
 	}
-	if err = s.setLoggedIn(ctx, loginToken); err != nil {
-		return LoginToken{}, err
+	if isLegacyPasswordHash(existing) {
+		// Upgrade passwords stored before they were hashed by the server, now that we have it.
+		if passwordHash, err := hashPassword(hashedPassword); err == nil {
+			if err = s.SetPasswordHash(ctx, user.Uuid, passwordHash); err != nil {
+				fmt.Printf("Failed to upgrade password hash: %v\n", err)
+			}
+		}
 	}
-	return loginToken, nil
-}
 
-func (s *Server) setLoggedIn(ctx context.Context, loginToken LoginToken) error {
-	loginTokenJSON, err := json.Marshal(loginToken)
-	if err != nil {
-		return err
-	}
-	loginTokenKey := fmt.Sprintf("%s_login_token", loginToken.UserEmail)
-	duration := time.Unix(loginToken.ValidUntil, 0).Sub(time.Now())
-	return s.RedisClient.Set(ctx, loginTokenKey, loginTokenJSON, duration).Err()
+	_, resp, err := s.newSession(ctx, user, device)
+	return resp, err
 }
 
-// Checks that a login token is correct, and matches the currently existing token kept on the
-// token.
-func (s *Server) ValidateLoginToken(token LoginToken) error {
+// Checks that a login token is correct, and returns the session it belongs to. Tokens issued
+// before users could have multiple sessions do not belong to one, and are instead checked
+// against the single token kept for the user.
+func (s *Server) sessionForLoginToken(ctx context.Context, token LoginToken) (*Session, error) {
 	if token.Expired() {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"Token has expired, was valid until %v & is now %v",
 			time.Unix(token.ValidUntil, 0), time.Now(),
 		)
 	}
-	loginTokenKey := fmt.Sprintf("%s_login_token", token.UserEmail)
-	tokenJSON, err := s.RedisClient.Get(context.TODO(), loginTokenKey).Bytes()
+	session, err := s.GetSession(ctx, token.Uuid)
 	if err != nil {
-		return err
+		return nil, err
+	} else if session != nil {
+		secret := token.Secret
+		token.Secret = ""
+		hash := []byte(hashSecret(secret))
+		if secret == "" || session.LoginToken != token ||
+			subtle.ConstantTimeCompare(hash, []byte(session.LoginTokenHash)) != 1 {
+			return nil, fmt.Errorf("Invalid login token")
+		}
+		// Clients which only send login tokens never refresh, so they last as long as the
+		// session rather than its access token.
+		if session.Expired() {
+			return nil, fmt.Errorf("Session has expired")
+		}
+		if err = s.checkTokensValidAfter(ctx, session.User, session.CreatedAt); err != nil {
+			return nil, err
+		}
+		return session, nil
 	}
-	var existingToken LoginToken
-	if err = json.Unmarshal(tokenJSON, &existingToken); err != nil {
-		return err
+
+	existingToken, err := s.LegacyLoginToken(ctx, token.UserEmail)
+	if err != nil {
+		return nil, err
+	} else if existingToken == nil {
+		return nil, fmt.Errorf("No login token exists for %v", token.UserEmail)
 	}
-	if existingToken != token {
-		return fmt.Errorf("Tokens do not match want: %v, got: %v", existingToken, token)
+	if *existingToken != token {
+		return nil, fmt.Errorf("Invalid login token")
 	}
 	if existingToken.Expired() {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"Token has expired, was valid until %v & is now %v",
 			time.Unix(existingToken.ValidUntil, 0),
 			time.Now(),
 		)
 	}
-	return nil
-}
-
-// Given a login token, it will return the user who used that login token. mu should not be
-// held.
-func (s *Server) UserFor(ctx context.Context, token LoginToken) (*User, bool) {
-	userJSON, err := s.RedisClient.HGet(ctx, "signed_up", string(token.UserEmail)).Bytes()
-	if err != nil || len(userJSON) == 0 {
-		return nil, false
+	user, err := s.UserByEmail(ctx, token.UserEmail)
+	if err != nil {
+		return nil, err
+	} else if user == nil {
+		return nil, fmt.Errorf("User does not exist")
 	}
-	var user User
-	if err := json.Unmarshal(userJSON, &user); err != nil {
-		return nil, false
+	issuedAt := time.Unix(existingToken.ValidUntil, 0).Add(-legacyLoginTokenDuration).Unix()
+	if err = s.checkTokensValidAfter(ctx, user.Uuid, issuedAt); err != nil {
+		return nil, err
 	}
-	return &user, true
+	return nil, nil
 }
 
 func (s *Server) MessageForReply(ctx context.Context, reply *MessageReply) (*Message, error) {
@@ -439,28 +397,19 @@ func distance(u1, u2, v1, v2 float64) float64 {
 
 func (s *Server) LogEmojiContent(e EmojiContent, localTime float64) {
 	ctx := context.TODO()
-	emojiString := string(e)
-	go s.RedisClient.HIncrBy(ctx, "emojis_sent", emojiString, 1).Err()
+	go s.IncrEmojiSent(ctx, e)
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	exists, err := s.RedisClient.HExists(ctx, "emoji_sent_at", emojiString).Result()
+	oldTime, exists, err := s.EmojiSentAt(ctx, e)
 	if err != nil {
 		return
 	}
 	var u float64
 	var v float64
 	if exists {
-		timeString, err := s.RedisClient.HGet(ctx, "emoji_sent_at", emojiString).Result()
-		if err != nil {
-			return
-		}
-		timeRaw, err := strconv.ParseFloat(timeString, 64)
-		if err != nil {
-			return
-		}
-		oldU, oldV := to2DTimeModular(timeRaw)
+		oldU, oldV := to2DTimeModular(oldTime)
 		newU, newV := to2DTimeModular(localTime)
 		u = weightedAverage(oldU, newU, 0.01)
 		v = weightedAverage(oldV, newV, 0.01)
@@ -468,17 +417,12 @@ func (s *Server) LogEmojiContent(e EmojiContent, localTime float64) {
 		u, v = to2DTimeModular(localTime)
 	}
 	newTime := from2DTimeModular(u, v)
-	err = s.RedisClient.HSet(
-		ctx, "emoji_sent_at", emojiString, strconv.FormatFloat(newTime, 'E', -1, 64),
-	).Err()
+	err = s.SetEmojiSentAt(ctx, e, newTime)
 	// TODO log error
 }
 
 func (s *Server) LogReply(r *MessageReply) {
-	ctx := context.TODO()
-	replyString := string(r.Reply)
-	go s.RedisClient.HIncrBy(ctx, "emoji_reply", replyString, 1).Err()
-	go s.RedisClient.HIncrBy(ctx, r.OriginalContent.RedisKey(), replyString, 1).Err()
+	go s.IncrReply(context.TODO(), r.OriginalContent, r.Reply)
 }
 
 // TODO weight the recommendations with how frequently they are sent.
@@ -486,17 +430,12 @@ func (s *Server) FindNearRecommendations(amt int, localTime float64) []EmojiCont
 	ctx := context.TODO()
 	u, v := to2DTimeModular(localTime)
 	out := make([]EmojiContent, 0, amt)
-	vals, err := s.RedisClient.HRandField(ctx, "emoji_sent_at", 75, true).Result()
+	sentAt, err := s.RandomEmojiSentAt(ctx, 75)
 	if err != nil {
 		return out
 	}
 
-	for i := 0; i < len(vals); i += 2 {
-		cntnt := EmojiContent(vals[i])
-		t, err := strconv.ParseFloat(vals[i+1], 64)
-		if err != nil {
-			continue
-		}
+	for cntnt, t := range sentAt {
 		newU, newV := to2DTimeModular(t)
 		dist := distance(u, newU, v, newV)
 		if dist < 0.05 {
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// testStores creates each kind of Store, which are cleaned up when the test finishes.
+var testStores = map[string]func(t *testing.T) Store{
+	"redis": func(t *testing.T) Store {
+		mr := miniredis.RunT(t)
+		return &RedisStore{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	},
+	"memory": func(t *testing.T) Store {
+		return NewMemoryStore()
+	},
+}
+
+// forEachStore runs f as a subtest against each kind of Store.
+func forEachStore(t *testing.T, f func(t *testing.T, store Store)) {
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			f(t, newStore(t))
+		})
+	}
+}
+
+// newTestServer starts a server backed by store, which is shut down when the test finishes.
+func newTestServer(t *testing.T, store Store) (*Server, *httptest.Server) {
+	t.Helper()
+	s := &Server{Store: store, Mailer: &LogMailer{W: ioutil.Discard}}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// newTestClients signs up n distinct users against ts.
+func newTestClients(t *testing.T, ts *httptest.Server, n int) []*mojiClient {
+	t.Helper()
+	clients := make([]*mojiClient, n)
+	for i := range clients {
+		clients[i] = NewMojiClient(ts.URL)
+		email := fmt.Sprintf("user%d@example.com", i)
+		if err := clients[i].SignUp(fmt.Sprintf("user%d", i), email); err != nil {
+			t.Fatalf("Failed to sign up %s: %v", email, err)
+		}
+	}
+	return clients
+}
+
+func TestConcurrentJoinGroup(t *testing.T) {
+	forEachStore(t, testConcurrentJoinGroup)
+}
+
+func testConcurrentJoinGroup(t *testing.T, store Store) {
+	s, ts := newTestServer(t, store)
+	clients := newTestClients(t, ts, 16)
+	group := Group{Uuid: Uuid(1), Name: "racers", Users: map[Uuid]string{}}
+	if err := s.AddGroup(context.Background(), &group); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *mojiClient) {
+			defer wg.Done()
+			if err := c.GroupOp("", group.Uuid, JoinGroup); err != nil {
+				t.Error(err)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	got, err := s.GetGroup(context.Background(), group.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Users) != len(clients) {
+		t.Errorf("Group has %d users after concurrent joins, want %d", len(got.Users), len(clients))
+	}
+}
+
+func TestConcurrentSignUp(t *testing.T) {
+	forEachStore(t, testConcurrentSignUp)
+}
+
+func testConcurrentSignUp(t *testing.T, store Store) {
+	s := &Server{Store: store}
+	ctx := context.Background()
+	const racers = 8
+	email := Email("racer@example.com")
+	errs := make(chan error, racers)
+	for i := 0; i < racers; i++ {
+		go func(i int) {
+			_, err := s.SignUp(ctx, email, fmt.Sprintf("racer %d", i), "test")
+			errs <- err
+		}(i)
+	}
+	created := 0
+	for i := 0; i < racers; i++ {
+		if err := <-errs; err == nil {
+			created++
+		} else if err != ErrUserExists {
+			t.Errorf("Unexpected error signing up: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d concurrent sign ups for one email succeeded, want 1", created)
+	}
+
+	user, err := store.UserByEmail(ctx, email)
+	if err != nil || user == nil {
+		t.Fatalf("Failed to find signed up user: %v", err)
+	}
+	if got, err := store.GetUser(ctx, user.Uuid); err != nil || got == nil || *got != *user {
+		t.Errorf("Signed up user %v does not match %v: %v", got, user, err)
+	}
+	if _, err := s.Login(ctx, email, "test", ""); err != nil {
+		t.Errorf("Failed to log in after signing up: %v", err)
+	}
+}
+
+func TestConcurrentSendRecvAck(t *testing.T) {
+	forEachStore(t, testConcurrentSendRecvAck)
+}
+
+func testConcurrentSendRecvAck(t *testing.T, store Store) {
+	s, ts := newTestServer(t, store)
+	clients := newTestClients(t, ts, 8)
+	group := Group{Uuid: Uuid(1), Name: "racers", Users: map[Uuid]string{}}
+	for _, c := range clients {
+		group.Users[c.UserID()] = c.user.Name
+		if err := s.AddUserToGroup(context.Background(), c.UserID(), group.Uuid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddGroup(context.Background(), &group); err != nil {
+		t.Fatal(err)
+	}
+
+	const rounds = 10
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(c *mojiClient, friend *mojiClient) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				msg := Message{Emojis: "🍕🍔🌯", SentAt: time.Now().Unix(), TTL: 60, LocalTime: 12}
+				if err := c.SendMsg(group.Uuid, MsgGroup, msg); err != nil {
+					t.Errorf("Failed to send to group: %v", err)
+					return
+				}
+				if err := c.SendMsg(friend.UserID(), MsgFriend, msg); err != nil {
+					t.Errorf("Failed to send to friend: %v", err)
+					return
+				}
+				recv, err := c.RecvMsg(r%2 == 0)
+				if err != nil {
+					t.Errorf("Failed to receive: %v", err)
+					return
+				}
+				for _, m := range recv.NewMessages {
+					if err := c.AckMsg(m.Uuid, "👍"); err != nil {
+						t.Errorf("Failed to ack %v: %v", m.Uuid, err)
+						return
+					}
+				}
+			}
+		}(c, clients[(i+1)%len(clients)])
+	}
+	wg.Wait()
+
+	for _, c := range clients {
+		if _, err := c.RecvMsg(true); err != nil {
+			t.Errorf("Failed to receive: %v", err)
+		}
+		if _, err := c.RecvMsg(false); err != nil {
+			t.Errorf("Failed to receive: %v", err)
+		}
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 2)
+		alice, bob := clients[0], clients[1]
+		ctx := context.Background()
+
+		if err := s.makeFriends(ctx, bob.UserID(), alice.UserID()); err != nil {
+			t.Fatal(err)
+		}
+		if err := alice.SetPushToken("ExponentPushToken[alice]"); err != nil {
+			t.Fatal(err)
+		}
+		alone := Group{Uuid: Uuid(1), Name: "alone", Users: map[Uuid]string{}}
+		shared := Group{Uuid: Uuid(2), Name: "shared", Users: map[Uuid]string{}}
+		alone.Users[alice.UserID()] = alice.user.Name
+		shared.Users[alice.UserID()] = alice.user.Name
+		shared.Users[bob.UserID()] = bob.user.Name
+		for _, group := range []*Group{&alone, &shared} {
+			if err := s.AddGroup(ctx, group); err != nil {
+				t.Fatal(err)
+			}
+			for uuid := range group.Users {
+				if err := s.AddUserToGroup(ctx, uuid, group.Uuid); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		banned, requested := Uuid(3), Uuid(4)
+		if err := store.BanFromGroup(ctx, banned, alice.UserID()); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddJoinRequest(ctx, requested, alice.UserID(), time.Now().Unix()); err != nil {
+			t.Fatal(err)
+		}
+		msg := Message{Emojis: "🍕🍔🌯", SentAt: time.Now().Unix(), TTL: 60, LocalTime: 12}
+		if err := alice.SendMsg(bob.UserID(), MsgFriend, msg); err != nil {
+			t.Fatal(err)
+		}
+		recv, err := bob.RecvMsg(false)
+		if err != nil || len(recv.NewMessages) != 1 {
+			t.Fatalf("Got %v, want a message from alice: %v", recv, err)
+		}
+		if err = bob.AckMsg(recv.NewMessages[0].Uuid, "👍"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = alice.DeleteAccount(); err != nil {
+			t.Fatal(err)
+		}
+
+		if user, err := store.GetUser(ctx, alice.UserID()); err != nil || user != nil {
+			t.Errorf("User still exists after deleting account: %v, %v", user, err)
+		}
+		if user, err := store.UserByEmail(ctx, alice.user.Email); err != nil || user != nil {
+			t.Errorf("User can still be found by email: %v, %v", user, err)
+		}
+		if _, err := s.Login(ctx, alice.user.Email, "test", ""); err == nil {
+			t.Error("Logged in to a deleted account")
+		}
+		if _, err := alice.RecvMsg(false); err == nil {
+			t.Error("Session of deleted account is still valid")
+		}
+		if token, _ := store.NotifToken(ctx, alice.UserID()); token != "" {
+			t.Errorf("Push token %q was kept", token)
+		}
+		if isFriend, _ := store.IsFriend(ctx, bob.UserID(), alice.UserID()); isFriend {
+			t.Error("Deleted user is still a friend")
+		}
+		if group, _ := store.GetGroup(ctx, alone.Uuid); group != nil {
+			t.Errorf("Emptied group %v was not deleted", group)
+		}
+		group, err := store.GetGroup(ctx, shared.Uuid)
+		if err != nil || group == nil {
+			t.Fatalf("Shared group was deleted: %v", err)
+		}
+		if _, member := group.Users[alice.UserID()]; member {
+			t.Error("Deleted user is still in group")
+		}
+		if member, _ := store.UserIsMemberOfGroup(ctx, alice.UserID(), shared.Uuid); member {
+			t.Error("Deleted user is still a member of group")
+		}
+		if isBanned, _ := store.IsBannedFromGroup(ctx, banned, alice.UserID()); isBanned {
+			t.Error("Deleted user is still banned from group")
+		}
+		if hasRequest, _ := store.HasJoinRequest(ctx, requested, alice.UserID()); hasRequest {
+			t.Error("Join request of deleted user was kept")
+		}
+		if groups, _ := store.GroupsForUser(ctx, alice.UserID()); len(groups) != 0 {
+			t.Errorf("Groups %v are still listed for deleted user", groups)
+		}
+
+		retained, err := store.GetMessage(ctx, recv.NewMessages[0].Uuid)
+		if err != nil || retained == nil {
+			t.Fatalf("Message was not retained: %v", err)
+		}
+		if retained.Source != deletedUser {
+			t.Errorf("Message source is %v, want it anonymized", retained.Source)
+		}
+		replies, err := store.ListRepliesForUser(ctx, bob.UserID())
+		if err != nil || len(replies) != 1 {
+			t.Fatalf("Got replies %v, want 1: %v", replies, err)
+		}
+		if replies[0].Message.Source != deletedUser {
+			t.Errorf("Replied to message source is %v, want it anonymized", replies[0].Message.Source)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrUserExists = errors.New("User already exists")
+
+// Store is the persistent state of the server. Methods which look up a single record return nil
+// without an error if the record does not exist. Implementations must be safe for concurrent use.
+type Store interface {
+	// Atomically creates a new user who signed up with hashedPassword, or returns ErrUserExists
+	// if a user with the same email has already signed up.
+	CreateUser(ctx context.Context, user *User, hashedPassword string) error
+	// Finds a user by the email they signed up with.
+	UserByEmail(ctx context.Context, email Email) (*User, error)
+	PasswordHash(ctx context.Context, user Uuid) (string, error)
+	SetPasswordHash(ctx context.Context, user Uuid, hashedPassword string) error
+
+	// Saves changes to a user who has already signed up.
+	AddUser(ctx context.Context, user *User) error
+	GetUser(ctx context.Context, uuid Uuid) (*User, error)
+	GetUsers(ctx context.Context) ([]User, error)
+	// Deletes a user along with everything kept only for them, which is their password, sessions,
+	// push token, friends, inbox and replies. Records shared with other users are left alone.
+	DeleteUser(ctx context.Context, user *User) error
+	// Replaces user as the source of retained messages and the sender of retained replies with
+	// anon.
+	AnonymizeUser(ctx context.Context, user Uuid, anon PublicUser) error
+
+	// Returns the single login token kept for a user before they could have multiple sessions.
+	LegacyLoginToken(ctx context.Context, email Email) (*LoginToken, error)
+	DeleteLegacyLoginToken(ctx context.Context, email Email) error
+	// Tokens and sessions of a user issued before this unix timestamp are no longer valid, or 0
+	// if it was never set.
+	SetTokensValidAfter(ctx context.Context, user Uuid, validAfter int64) error
+	TokensValidAfter(ctx context.Context, user Uuid) (int64, error)
+
+	// Saves or updates a session, which will expire after its ValidUntil.
+	AddSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, uuid Uuid) (*Session, error)
+	DeleteSession(ctx context.Context, user, uuid Uuid) error
+	// Returns all unexpired sessions of a user.
+	SessionsForUser(ctx context.Context, user Uuid) ([]Session, error)
+	DeleteSessionsForUser(ctx context.Context, user Uuid) error
+
+	// Saves a code emailed to a user, replacing any earlier one of the same kind. It expires after
+	// its ValidUntil.
+	SetEmailCode(ctx context.Context, kind EmailCodeKind, code *EmailCode) error
+	GetEmailCode(ctx context.Context, kind EmailCodeKind, user Uuid) (*EmailCode, error)
+	DeleteEmailCode(ctx context.Context, kind EmailCodeKind, user Uuid) error
+
+	SetNotifToken(ctx context.Context, user Uuid, token string) error
+	// Returns the push notification token for a user, or "" if they do not have one.
+	NotifToken(ctx context.Context, user Uuid) (string, error)
+	DeleteNotifToken(ctx context.Context, user Uuid) error
+
+	AddFriend(ctx context.Context, user, friend Uuid) error
+	RemoveFriend(ctx context.Context, user, friend Uuid) error
+	IsFriend(ctx context.Context, user, friend Uuid) (bool, error)
+	ListFriends(ctx context.Context, user Uuid) ([]Uuid, error)
+
+	// Records that user blocked other.
+	Block(ctx context.Context, user, other Uuid) error
+	Unblock(ctx context.Context, user, other Uuid) error
+	HasBlocked(ctx context.Context, user, other Uuid) (bool, error)
+	// Returns who user has blocked.
+	ListBlocked(ctx context.Context, user Uuid) ([]Uuid, error)
+	// Returns who has blocked user.
+	ListBlockedBy(ctx context.Context, user Uuid) ([]Uuid, error)
+
+	// Records that from asked to be friends with to at sentAt.
+	AddFriendRequest(ctx context.Context, from, to Uuid, sentAt int64) error
+	DeleteFriendRequest(ctx context.Context, from, to Uuid) error
+	HasFriendRequest(ctx context.Context, from, to Uuid) (bool, error)
+	// Returns who asked to be friends with user, oldest first.
+	IncomingFriendRequests(ctx context.Context, user Uuid) ([]Uuid, error)
+	// Returns who user asked to be friends with, oldest first.
+	OutgoingFriendRequests(ctx context.Context, user Uuid) ([]Uuid, error)
+
+	AddGroup(ctx context.Context, group *Group) error
+	// Deletes a group along with its members, bans, invites and join requests.
+	DeleteGroup(ctx context.Context, uuid Uuid) error
+	GetGroup(ctx context.Context, uuid Uuid) (*Group, error)
+	GetGroups(ctx context.Context) ([]Group, error)
+	AddUserToGroup(ctx context.Context, user, group Uuid) error
+	DeleteUserFromGroup(ctx context.Context, user, group Uuid) error
+	UserIsMemberOfGroup(ctx context.Context, user, group Uuid) (bool, error)
+	UsersInGroup(ctx context.Context, group Uuid) ([]Uuid, error)
+	// Returns every group user was added to, banned from or asked to join. Groups stay listed
+	// after that is undone or they are deleted, so callers must check what is left.
+	GroupsForUser(ctx context.Context, user Uuid) ([]Uuid, error)
+
+	// Stops user from joining group until they are unbanned.
+	BanFromGroup(ctx context.Context, group, user Uuid) error
+	UnbanFromGroup(ctx context.Context, group, user Uuid) error
+	IsBannedFromGroup(ctx context.Context, group, user Uuid) (bool, error)
+	BannedFromGroup(ctx context.Context, group Uuid) ([]Uuid, error)
+
+	// Records that user asked to join group at sentAt.
+	AddJoinRequest(ctx context.Context, group, user Uuid, sentAt int64) error
+	DeleteJoinRequest(ctx context.Context, group, user Uuid) error
+	HasJoinRequest(ctx context.Context, group, user Uuid) (bool, error)
+	// Returns who asked to join group, oldest first.
+	JoinRequests(ctx context.Context, group Uuid) ([]Uuid, error)
+
+	// Saves or updates an invite, which will expire after its ValidUntil.
+	AddGroupInvite(ctx context.Context, invite *GroupInvite) error
+	GetGroupInvite(ctx context.Context, code string) (*GroupInvite, error)
+	DeleteGroupInvite(ctx context.Context, group Uuid, code string) error
+	// Returns all unexpired invites to a group.
+	GroupInvites(ctx context.Context, group Uuid) ([]GroupInvite, error)
+
+	// Saves a message, which will expire after its TTL.
+	AddMessage(ctx context.Context, msg *Message) error
+	GetMessage(ctx context.Context, uuid Uuid) (*Message, error)
+	DeleteMessage(ctx context.Context, uuid Uuid) error
+
+	// Adds a message to the inbox of the recipient, ordered by when it was sent.
+	AddToInbox(ctx context.Context, recipient Uuid, msg *Message) error
+	RemoveFromInbox(ctx context.Context, recipient, msg Uuid) error
+	ClearInbox(ctx context.Context, recipient Uuid) error
+	// Returns all unexpired messages in the inbox of recipient, oldest first. Entries whose
+	// message has expired or no longer exists are trimmed from the inbox.
+	InboxMessages(ctx context.Context, recipient Uuid) ([]*Message, error)
+
+	// Saves a reply, which will expire at the same time as the message it replies to.
+	AddReply(ctx context.Context, reply *MessageReply) error
+	GetReply(ctx context.Context, uuid Uuid) (*MessageReply, error)
+	// Queues a reply so that it will be seen by user.
+	AddReplyForUser(ctx context.Context, user Uuid, reply *MessageReply) error
+	ClearRepliesForUser(ctx context.Context, user Uuid) error
+	// Returns all replies queued for user, oldest first. Replies which have expired along with
+	// their message are trimmed from the queue.
+	ListRepliesForUser(ctx context.Context, user Uuid) ([]*MessageReply, error)
+
+	// Adds a report to the moderation queue.
+	AddReport(ctx context.Context, report *Report) error
+	// Returns every report in the moderation queue, oldest first.
+	ListReports(ctx context.Context) ([]Report, error)
+	DeleteReport(ctx context.Context, uuid Uuid) error
+
+	IncrEmojiSent(ctx context.Context, e EmojiContent) error
+	// Returns the average local time an emoji is sent at, and whether it has been sent before.
+	EmojiSentAt(ctx context.Context, e EmojiContent) (float64, bool, error)
+	SetEmojiSentAt(ctx context.Context, e EmojiContent, localTime float64) error
+	// Returns the average local time for up to n random emojis which have been sent.
+	RandomEmojiSentAt(ctx context.Context, n int) (map[EmojiContent]float64, error)
+	IncrReply(ctx context.Context, original EmojiContent, reply EmojiReply) error
+	Summary(ctx context.Context) (*SummaryResponse, error)
+
+	// Deletes everything in the store.
+	Reset(ctx context.Context) error
+}
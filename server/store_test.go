@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStoreMissingRecords(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		if user, err := store.GetUser(ctx, Uuid(1)); user != nil || err != nil {
+			t.Errorf("GetUser of missing user = %v, %v", user, err)
+		}
+		if user, err := store.UserByEmail(ctx, "a@example.com"); user != nil || err != nil {
+			t.Errorf("UserByEmail of missing user = %v, %v", user, err)
+		}
+		if group, err := store.GetGroup(ctx, Uuid(1)); group != nil || err != nil {
+			t.Errorf("GetGroup of missing group = %v, %v", group, err)
+		}
+		if msg, err := store.GetMessage(ctx, Uuid(1)); msg != nil || err != nil {
+			t.Errorf("GetMessage of missing message = %v, %v", msg, err)
+		}
+		if token, err := store.NotifToken(ctx, Uuid(1)); token != "" || err != nil {
+			t.Errorf("NotifToken of missing user = %q, %v", token, err)
+		}
+	})
+}
+
+// Returns whether got holds the same uuids as want in any order.
+func sameUuids(got, want []Uuid) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	counts := map[Uuid]int{}
+	for _, uuid := range want {
+		counts[uuid]++
+	}
+	for _, uuid := range got {
+		if counts[uuid] == 0 {
+			return false
+		}
+		counts[uuid]--
+	}
+	return true
+}
+
+func TestStoreFriends(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		user, alice, bob := Uuid(1), Uuid(2), Uuid(3)
+		for _, friend := range []Uuid{alice, bob} {
+			if err := store.AddFriend(ctx, user, friend); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Adding a friend twice keeps one of them.
+		if err := store.AddFriend(ctx, user, alice); err != nil {
+			t.Fatal(err)
+		}
+		if isFriend, err := store.IsFriend(ctx, user, alice); err != nil || !isFriend {
+			t.Errorf("IsFriend of added friend = %v, %v", isFriend, err)
+		}
+		// Friends are only stored in the direction they were added.
+		if isFriend, err := store.IsFriend(ctx, alice, user); err != nil || isFriend {
+			t.Errorf("IsFriend in the other direction = %v, %v", isFriend, err)
+		}
+		if friends, err := store.ListFriends(ctx, user); err != nil || !sameUuids(friends, []Uuid{alice, bob}) {
+			t.Errorf("ListFriends = %v, %v, want %v", friends, err, []Uuid{alice, bob})
+		}
+
+		if err := store.RemoveFriend(ctx, user, alice); err != nil {
+			t.Fatal(err)
+		}
+		if isFriend, err := store.IsFriend(ctx, user, alice); err != nil || isFriend {
+			t.Errorf("IsFriend of removed friend = %v, %v", isFriend, err)
+		}
+		if friends, err := store.ListFriends(ctx, user); err != nil || !sameUuids(friends, []Uuid{bob}) {
+			t.Errorf("ListFriends = %v, %v, want %v", friends, err, []Uuid{bob})
+		}
+		if friends, err := store.ListFriends(ctx, alice); err != nil || len(friends) != 0 {
+			t.Errorf("ListFriends of user without friends = %v, %v", friends, err)
+		}
+	})
+}
+
+// Returns the uuids of msgs in order.
+func messageUuids(msgs []*Message) []Uuid {
+	uuids := make([]Uuid, len(msgs))
+	for i, msg := range msgs {
+		uuids[i] = msg.Uuid
+	}
+	return uuids
+}
+
+func TestStoreInbox(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		recipient, other := Uuid(1), Uuid(2)
+		now := time.Now().Unix()
+		older := &Message{Uuid: Uuid(3), SentAt: now - 10, TTL: 60}
+		newer := &Message{Uuid: Uuid(4), SentAt: now, TTL: 60}
+		// Added newest first, but listed oldest first.
+		for _, msg := range []*Message{newer, older} {
+			if err := store.AddMessage(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AddToInbox(ctx, recipient, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.AddToInbox(ctx, other, newer); err != nil {
+			t.Fatal(err)
+		}
+
+		msgs, err := store.InboxMessages(ctx, recipient)
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := messageUuids(msgs), []Uuid{older.Uuid, newer.Uuid}; !reflect.DeepEqual(got, want) {
+			t.Errorf("InboxMessages = %v, want %v", got, want)
+		}
+
+		if err = store.RemoveFromInbox(ctx, recipient, older.Uuid); err != nil {
+			t.Fatal(err)
+		}
+		if msgs, err = store.InboxMessages(ctx, recipient); err != nil {
+			t.Fatal(err)
+		} else if got, want := messageUuids(msgs), []Uuid{newer.Uuid}; !reflect.DeepEqual(got, want) {
+			t.Errorf("InboxMessages after removing = %v, want %v", got, want)
+		}
+		// Removing from an inbox keeps the message itself.
+		if msg, err := store.GetMessage(ctx, older.Uuid); err != nil || msg == nil {
+			t.Errorf("GetMessage of message removed from inbox = %v, %v", msg, err)
+		}
+
+		if err = store.ClearInbox(ctx, recipient); err != nil {
+			t.Fatal(err)
+		}
+		if msgs, err = store.InboxMessages(ctx, recipient); err != nil || len(msgs) != 0 {
+			t.Errorf("InboxMessages after clearing = %v, %v", msgs, err)
+		}
+		if msgs, err = store.InboxMessages(ctx, other); err != nil || len(msgs) != 1 {
+			t.Errorf("InboxMessages of other recipient = %v, %v", msgs, err)
+		}
+	})
+}
+
+func TestStoreReplies(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		user, other := Uuid(1), Uuid(2)
+		now := time.Now().Unix()
+		msg := &Message{Uuid: Uuid(3), SentAt: now, TTL: 60}
+		older := &MessageReply{Uuid: Uuid(4), Message: msg, Reply: "👍", SentAt: now - 10}
+		newer := &MessageReply{Uuid: Uuid(5), Message: msg, Reply: "👎", SentAt: now}
+		for _, reply := range []*MessageReply{newer, older} {
+			if err := store.AddReply(ctx, reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := store.GetReply(ctx, older.Uuid)
+		if err != nil || got == nil {
+			t.Fatalf("GetReply = %v, %v", got, err)
+		} else if got.Reply != older.Reply || got.Message.Uuid != msg.Uuid {
+			t.Errorf("GetReply = %+v, want %+v", got, older)
+		}
+		if got, err = store.GetReply(ctx, Uuid(6)); err != nil || got != nil {
+			t.Errorf("GetReply of missing reply = %v, %v", got, err)
+		}
+
+		// Queued newest first, but listed oldest first.
+		for _, reply := range []*MessageReply{newer, older} {
+			if err = store.AddReplyForUser(ctx, user, reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = store.AddReplyForUser(ctx, other, newer); err != nil {
+			t.Fatal(err)
+		}
+		replies, err := store.ListRepliesForUser(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(replies) != 2 || replies[0].Uuid != older.Uuid || replies[1].Uuid != newer.Uuid {
+			t.Errorf("ListRepliesForUser = %v, want %v then %v", replies, older.Uuid, newer.Uuid)
+		}
+
+		if err = store.ClearRepliesForUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if replies, err = store.ListRepliesForUser(ctx, user); err != nil || len(replies) != 0 {
+			t.Errorf("ListRepliesForUser after clearing = %v, %v", replies, err)
+		}
+		if replies, err = store.ListRepliesForUser(ctx, other); err != nil || len(replies) != 1 {
+			t.Errorf("ListRepliesForUser of other user = %v, %v", replies, err)
+		}
+		// Clearing the queue keeps the replies themselves.
+		if got, err = store.GetReply(ctx, newer.Uuid); err != nil || got == nil {
+			t.Errorf("GetReply of cleared reply = %v, %v", got, err)
+		}
+	})
+}
+
+func TestStoreGroupsForUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		user, member, banned, requested := Uuid(1), Uuid(2), Uuid(3), Uuid(4)
+		if err := store.AddUserToGroup(ctx, user, member); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.BanFromGroup(ctx, banned, user); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddJoinRequest(ctx, requested, user, time.Now().Unix()); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.DeleteUserFromGroup(ctx, user, member); err != nil {
+			t.Fatal(err)
+		}
+		want := []Uuid{member, banned, requested}
+		if groups, err := store.GroupsForUser(ctx, user); err != nil || !sameUuids(groups, want) {
+			t.Errorf("GroupsForUser = %v, %v, want %v", groups, err, want)
+		}
+	})
+}
+
+func TestStoreMessageWithoutTTL(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		msg := &Message{Uuid: Uuid(1), SentAt: time.Now().Unix()}
+		if err := store.AddMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.GetMessage(ctx, msg.Uuid); err != nil || got == nil {
+			t.Errorf("GetMessage of message without a TTL = %v, %v", got, err)
+		}
+	})
+}
+
+func TestStoreTrimsExpiredMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		recipient := Uuid(1)
+		now := time.Now().Unix()
+		live := &Message{Uuid: Uuid(2), SentAt: now, TTL: 60}
+		// Still kept by the store, but expired according to when it was sent.
+		stale := &Message{Uuid: Uuid(3), SentAt: now - 120, TTL: 60}
+		for _, msg := range []*Message{live, stale} {
+			if err := store.AddMessage(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AddToInbox(ctx, recipient, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Never saved at all.
+		if err := store.AddToInbox(ctx, recipient, &Message{Uuid: Uuid(4), SentAt: now}); err != nil {
+			t.Fatal(err)
+		}
+
+		msgs, err := store.InboxMessages(ctx, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 1 || msgs[0].Uuid != live.Uuid {
+			t.Fatalf("InboxMessages = %v, want only %v", msgs, live.Uuid)
+		}
+
+		reply := &MessageReply{Uuid: Uuid(5), Message: live, SentAt: now}
+		if err := store.AddReply(ctx, reply); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddReply(ctx, &MessageReply{Uuid: Uuid(6), Message: stale}); err == nil {
+			t.Error("Expected error replying to expired message")
+		}
+		if err := store.AddReplyForUser(ctx, recipient, reply); err != nil {
+			t.Fatal(err)
+		}
+		replies, err := store.ListRepliesForUser(ctx, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(replies) != 1 || replies[0].Uuid != reply.Uuid {
+			t.Errorf("ListRepliesForUser = %v, want only %v", replies, reply.Uuid)
+		}
+	})
+}
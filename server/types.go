@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"net/mail"
 	"strconv"
 	"strings"
@@ -36,7 +37,66 @@ type User struct {
 	Uuid  Uuid   `json:"uuid,string"`
 	Name  string `json:"name"`
 	Email Email  `json:"email"`
-	// TODO add other preference fields here
+	// Whether the user has confirmed they own Email.
+	Verified bool `json:"verified"`
+
+	// Number of seconds messages live for when sent without a TTL, or 0 to leave it to the client.
+	DefaultTTL int64 `json:"defaultTTL,string,omitempty"`
+	// IANA name of the user's time zone, such as "America/New_York", or "" for UTC.
+	TimeZone string `json:"timeZone,omitempty"`
+	// Hours 0-23 in TimeZone from which until QuietHoursEnd the user gets no push notifications.
+	// There are no quiet hours if they are equal.
+	QuietHoursStart int `json:"quietHoursStart,omitempty"`
+	QuietHoursEnd   int `json:"quietHoursEnd,omitempty"`
+	// Whether the user is hidden from people who are not their friends in ListPeople.
+	Undiscoverable bool `json:"undiscoverable,omitempty"`
+	// Who can send the user direct messages.
+	DirectMessages DMPolicy `json:"directMessages,omitempty"`
+	// Suspended users cannot log in, which is set by admins.
+	Suspended bool `json:"suspended,omitempty"`
+}
+
+// PublicUser is what other users can see of a user, leaving out their preferences and account
+// state.
+type PublicUser struct {
+	Uuid Uuid   `json:"uuid,string"`
+	Name string `json:"name"`
+	// Clients tell their own messages and replies apart from others by email.
+	Email Email `json:"email"`
+}
+
+func (u *User) Public() PublicUser {
+	return PublicUser{Uuid: u.Uuid, Name: u.Name, Email: u.Email}
+}
+
+// DMPolicy is who a user accepts direct messages from.
+type DMPolicy int
+
+const (
+	DMEveryone DMPolicy = iota
+	DMFriends
+	// Friends, and friends of friends.
+	DMFriendsOfFriends
+)
+
+func (p DMPolicy) IsValid() bool {
+	return p >= DMEveryone && p <= DMFriendsOfFriends
+}
+
+// Returns whether t is during the user's quiet hours.
+func (u *User) InQuietHours(t time.Time) bool {
+	if u.QuietHoursStart == u.QuietHoursEnd {
+		return false
+	}
+	if loc, err := time.LoadLocation(u.TimeZone); err == nil {
+		t = t.In(loc)
+	}
+	hour := t.Hour()
+	if u.QuietHoursStart < u.QuietHoursEnd {
+		return u.QuietHoursStart <= hour && hour < u.QuietHoursEnd
+	}
+	// Quiet hours go past midnight
+	return hour >= u.QuietHoursStart || hour < u.QuietHoursEnd
 }
 
 type Group struct {
@@ -44,10 +104,84 @@ type Group struct {
 	// Display Name, need not be unique
 	Name  string          `json:"name"`
 	Users map[Uuid]string `json:"users"`
-	// TODO should this have a location attached as well?
+	// What the group is about.
+	Description string `json:"description,omitempty"`
+	// An emoji which represents the group.
+	Emoji EmojiContent `json:"emoji,omitempty"`
+	// Where the group is based, if anywhere.
+	Location *GeoLocation `json:"location,omitempty"`
+	// Unix timestamp, or 0 for groups created before it was recorded.
+	CreatedAt int64 `json:"createdAt,string,omitempty"`
+	// Most members the group can have, or 0 for as many as the server allows.
+	MemberLimit int `json:"memberLimit,omitempty"`
+	// Whether the group locks itself once it is full.
+	LockWhenFull bool `json:"lockWhenFull,omitempty"`
 
 	// Whether new users can join this group or not. It will never be displayed
 	Locked bool `json:"locked"`
+
+	// Who created the group, or who it was passed on to when they left. Groups created before
+	// groups had owners are given one by assignGroupOwners.
+	Owner Uuid `json:"owner,omitempty,string"`
+	// Members other than the owner who can administer the group.
+	Admins map[Uuid]bool `json:"admins,omitempty"`
+}
+
+func (g *Group) IsMember(user Uuid) bool {
+	_, member := g.Users[user]
+	return member
+}
+
+// Returns whether user can lock, rename, kick from and promote in the group.
+func (g *Group) IsAdmin(user Uuid) bool {
+	if !g.IsMember(user) {
+		return false
+	}
+	return g.Owner == user || g.Admins[user]
+}
+
+// GeoLocation is a point on earth along with a name for it.
+type GeoLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Label     string  `json:"label,omitempty"`
+}
+
+// Mean radius of the earth in kilometers.
+const earthRadiusKm = 6371
+
+func (l GeoLocation) IsValid() bool {
+	return l.Latitude >= -90 && l.Latitude <= 90 && l.Longitude >= -180 && l.Longitude <= 180
+}
+
+// Returns the distance in kilometers between two locations along the surface of the earth,
+// using the haversine formula.
+func (l GeoLocation) DistanceKm(o GeoLocation) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	lat1, lat2 := toRadians(l.Latitude), toRadians(o.Latitude)
+	dLat, dLong := lat2-lat1, toRadians(o.Longitude-l.Longitude)
+	a := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLong/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// GroupInvite lets whoever has its Code join a group, even when it is locked.
+type GroupInvite struct {
+	Code      string `json:"code"`
+	Group     Uuid   `json:"group,string"`
+	CreatedBy Uuid   `json:"createdBy,string"`
+	// How many times the invite can be used, or 0 for no limit.
+	MaxUses int `json:"maxUses"`
+	Uses    int `json:"uses"`
+	// Unix timestamp
+	ValidUntil int64 `json:"validUntil,string"`
+}
+
+func (i *GroupInvite) Expired() bool {
+	return time.Unix(i.ValidUntil, 0).Before(time.Now())
+}
+
+func GroupInviteRedisKey(code string) string {
+	return fmt.Sprintf("group_invite_%s", code)
 }
 
 // Message is a struct that represents an emoji message between two people
@@ -60,7 +194,7 @@ type Message struct {
 	Group Uuid `json:"groupSentTo,omitempty"`
 
 	Emojis   EmojiContent `json:"emojis"`
-	Source   User         `json:"source"`
+	Source   PublicUser   `json:"source"`
 	Location string       `json:"location"`
 	// Unix timestamp for current time.
 	SentAt int64 `json:"sentAt,string"`
@@ -72,26 +206,38 @@ type Message struct {
 }
 
 func (m *Message) Expired(now time.Time) bool {
-	t := time.Unix(m.SentAt, 0)
-	return t.Add(time.Duration(m.TTL) * time.Second).Before(now)
+	return m.ExpiresAt().Before(now)
 }
 
 func MessageRedisKey(uuid Uuid) string {
 	return fmt.Sprintf("message_%d", uuid)
 }
 
+// Returns when this message will expire.
+func (m *Message) ExpiresAt() time.Time {
+	return time.Unix(m.SentAt, 0).Add(time.Duration(m.TTL) * time.Second)
+}
+
 type MessageReply struct {
+	Uuid    Uuid     `json:"uuid,string"`
 	Message *Message `json:"message"`
 	Group   Uuid     `json:"group"`
 
 	// This is so the user can see what they originally sent
 	OriginalContent EmojiContent `json:"originalContent"`
 	Reply           EmojiReply   `json:"reply"`
-	From            User         `json:"from"`
+	From            PublicUser   `json:"from"`
 	// Unix timestamp
 	SentAt int64 `json:"sentAt,string"`
 }
 
+func ReplyRedisKey(uuid Uuid) string {
+	return fmt.Sprintf("reply_%d", uuid)
+}
+
+// LoginToken is sent in the body of requests to authenticate them.
+//
+// Deprecated: send the session token from LoginResponse in an Authorization header instead.
 type LoginToken struct {
 	// Unix Timestamp
 	ValidUntil int64 `json:"validUntil,string"`
@@ -101,12 +247,111 @@ type LoginToken struct {
 	Uuid Uuid `json:"uuid,string"`
 
 	UserEmail Email `json:"userEmail"`
+	// Random secret of tokens issued for a session, since the Uuid is not secret. Tokens issued
+	// before sessions existed do not have one.
+	Secret string `json:"secret,omitempty"`
 }
 
 func (lt *LoginToken) Expired() bool {
 	return time.Unix(lt.ValidUntil, 0).Before(time.Now())
 }
 
+// Session is a login of a user on one device, authenticated by an opaque bearer token or the
+// LoginToken issued along with it.
+type Session struct {
+	// Same as the Uuid of LoginToken.
+	Uuid Uuid `json:"uuid,string"`
+	User Uuid `json:"user,string"`
+	// Name of the device which logged in, as reported by the client.
+	Device string `json:"device"`
+	// The LoginToken issued for the session without its Secret, which is only kept hashed.
+	LoginToken     LoginToken `json:"loginToken"`
+	LoginTokenHash string     `json:"loginTokenHash"`
+	// Expo push token registered from this session's device, so it can be removed on logout.
+	NotifToken string `json:"notifToken,omitempty"`
+	// Hashes of the secret part of the access and refresh tokens, the tokens themselves are
+	// never stored.
+	AccessTokenHash  string `json:"accessTokenHash"`
+	RefreshTokenHash string `json:"refreshTokenHash"`
+	// Hashes of refresh tokens which have already been rotated out, most recent last. Seeing one
+	// of these again means the refresh token has been stolen.
+	UsedRefreshTokenHashes []string `json:"usedRefreshTokenHashes"`
+	// Unix timestamps
+	CreatedAt        int64 `json:"createdAt,string"`
+	LastSeen         int64 `json:"lastSeen,string"`
+	AccessValidUntil int64 `json:"accessValidUntil,string"`
+	// When the refresh token expires, after which the session is gone.
+	ValidUntil int64 `json:"validUntil,string"`
+}
+
+func (s *Session) Expired() bool {
+	return time.Unix(s.ValidUntil, 0).Before(time.Now())
+}
+
+func SessionRedisKey(uuid Uuid) string {
+	return fmt.Sprintf("session_%d", uuid)
+}
+
+type EmailCodeKind int
+
+const (
+	PasswordResetCode EmailCodeKind = iota
+	VerifyEmailCode
+)
+
+// EmailCode is a code which was emailed to a user to confirm they own their email, such as
+// before resetting their password.
+type EmailCode struct {
+	User     Uuid   `json:"user,string"`
+	CodeHash string `json:"codeHash"`
+	// Number of wrong codes which have been tried.
+	Attempts int `json:"attempts"`
+	// Unix timestamps
+	IssuedAt   int64 `json:"issuedAt,string,omitempty"`
+	ValidUntil int64 `json:"validUntil,string"`
+}
+
+func (c *EmailCode) Expired() bool {
+	return time.Unix(c.ValidUntil, 0).Before(time.Now())
+}
+
+func EmailCodeRedisKey(kind EmailCodeKind, user Uuid) string {
+	switch kind {
+	case PasswordResetCode:
+		return fmt.Sprintf("password_reset_%d", user)
+	case VerifyEmailCode:
+		return fmt.Sprintf("verify_email_%d", user)
+	default:
+		return fmt.Sprintf("email_code_%d_%d", kind, user)
+	}
+}
+
+type ReportKind int
+
+const (
+	ReportMessage ReportKind = iota
+	ReportUser
+	ReportGroup
+)
+
+// Report is a complaint about a message, user or group, which waits for an admin to deal with it.
+type Report struct {
+	Uuid     Uuid       `json:"uuid,string"`
+	Reporter Uuid       `json:"reporter,string"`
+	Kind     ReportKind `json:"kind"`
+	// Uuid of the message, user or group which was reported.
+	Target Uuid   `json:"target,string"`
+	Reason string `json:"reason"`
+	// What was reported as it was at the time, since messages expire and names change. This is the
+	// emojis of a message, or the name of a user or group.
+	Content string `json:"content"`
+	// Who is responsible for what was reported, which is the sender of a message or the reported
+	// user, or InvalidUuid for groups.
+	Offender Uuid `json:"offender,string,omitempty"`
+	// Unix timestamp
+	CreatedAt int64 `json:"createdAt,string"`
+}
+
 // Uuid represents a unique identifier, temporary for now but maybe upgrade to [2]uint64
 // at some point.
 type Uuid uint64
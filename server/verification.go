@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// How long a code for verifying an email can be used for.
+const emailVerificationDuration = 24 * time.Hour
+
+// UnverifiedRestrictions are what users who have not verified their email cannot do. By default
+// there are none.
+type UnverifiedRestrictions struct {
+	// Unverified users cannot send messages to groups.
+	GroupMessages bool
+	// Unverified users are not shown to others in ListPeople, except to their friends.
+	ListPeople bool
+}
+
+// Reads restrictions from MOJI_UNVERIFIED_RESTRICTIONS, a comma separated list of
+// "group_msgs" and "list_people".
+func UnverifiedRestrictionsFromEnv() UnverifiedRestrictions {
+	var r UnverifiedRestrictions
+	for _, name := range strings.Split(os.Getenv("MOJI_UNVERIFIED_RESTRICTIONS"), ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "group_msgs":
+			r.GroupMessages = true
+		case "list_people":
+			r.ListPeople = true
+		default:
+			fmt.Printf("Unknown restriction for unverified users %q\n", name)
+		}
+	}
+	return r
+}
+
+// Emails user a code which they can confirm their email with.
+func (s *Server) SendVerificationEmail(ctx context.Context, user *User) error {
+	if user.Verified {
+		return fmt.Errorf("Email is already verified")
+	}
+	code, err := s.issueEmailCode(ctx, VerifyEmailCode, user.Uuid, emailVerificationDuration)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(
+		"Welcome to 3moji, %s! Your code to verify your email is %s. It expires in %v.",
+		user.Name, code, emailVerificationDuration,
+	)
+	return s.Mailer.SendMail(user.Email, "Verify your 3moji email", body)
+}
+
+// Marks the email of user as verified if code is the one which was emailed to them.
+func (s *Server) ConfirmEmail(ctx context.Context, user Uuid, code string) (*User, error) {
+	if err := s.useEmailCode(ctx, VerifyEmailCode, user, code); err != nil {
+		return nil, err
+	}
+	return s.updateUser(ctx, user, func(user *User) error {
+		user.Verified = true
+		return nil
+	})
+}
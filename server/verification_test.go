@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEmailVerification(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		var mail bytes.Buffer
+		s.Mailer = &LogMailer{W: &mail}
+		c := newTestClients(t, ts, 1)[0]
+		ctx := context.Background()
+
+		if c.user.Verified {
+			t.Fatal("User was verified on signing up")
+		}
+		code := resetCodePattern.FindString(mail.String())
+		if code == "" {
+			t.Fatalf("Did not mail a verification code on signing up:\n%s", mail.String())
+		}
+		wrong := "00000000"
+		if code == wrong {
+			wrong = "11111111"
+		}
+		if err := c.VerifyEmail(ConfirmVerification, wrong); err == nil {
+			t.Error("Verified email with the wrong code")
+		}
+		if err := c.VerifyEmail(ConfirmVerification, code); err != nil {
+			t.Fatal(err)
+		}
+
+		// Both copies of the user must be updated.
+		if user, err := store.GetUser(ctx, c.user.Uuid); err != nil || !user.Verified {
+			t.Errorf("User was not verified: %v", err)
+		}
+		if user, err := store.UserByEmail(ctx, c.user.Email); err != nil || !user.Verified {
+			t.Errorf("User found by email was not verified: %v", err)
+		}
+		if err := c.VerifyEmail(ResendVerification, ""); err == nil {
+			t.Error("Sent a verification code to a verified user")
+		}
+	})
+}
+
+func TestUnverifiedRestrictions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s, ts := newTestServer(t, store)
+		clients := newTestClients(t, ts, 2)
+		ctx := context.Background()
+		group := Group{Uuid: Uuid(1), Name: "verified", Users: map[Uuid]string{}}
+		for _, c := range clients {
+			group.Users[c.UserID()] = c.user.Name
+		}
+		if err := s.AddGroup(ctx, &group); err != nil {
+			t.Fatal(err)
+		}
+		msg := Message{Emojis: "🍕🍔🌯", SentAt: time.Now().Unix(), TTL: 60, LocalTime: 12}
+
+		// Nothing is restricted by default.
+		if err := clients[0].SendMsg(group.Uuid, MsgGroup, msg); err != nil {
+			t.Errorf("Unrestricted user could not message group: %v", err)
+		}
+		if people, err := clients[1].ListPeople(All); err != nil || len(people) != 1 {
+			t.Errorf("Got %v listing unrestricted people, want 1: %v", people, err)
+		}
+
+		s.Unverified = UnverifiedRestrictions{GroupMessages: true, ListPeople: true}
+		if err := clients[0].SendMsg(group.Uuid, MsgGroup, msg); err == nil {
+			t.Error("Unverified user messaged a group")
+		}
+		if people, err := clients[1].ListPeople(All); err != nil || len(people) != 0 {
+			t.Errorf("Got %v listing people, want no unverified people: %v", people, err)
+		}
+
+		_, err := s.updateUser(ctx, clients[0].UserID(), func(user *User) error {
+			user.Verified = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := clients[0].SendMsg(group.Uuid, MsgGroup, msg); err != nil {
+			t.Errorf("Verified user could not message group: %v", err)
+		}
+		if people, err := clients[1].ListPeople(All); err != nil || len(people) != 1 {
+			t.Errorf("Got %v listing people, want the verified user: %v", people, err)
+		}
+	})
+}